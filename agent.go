@@ -0,0 +1,107 @@
+package gossh
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// agentSocket returns the socket of the running ssh-agent given by
+// SSH_AUTH_SOCK
+func agentSocket() (string, error) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return "", fmt.Errorf("no ssh-agent: SSH_AUTH_SOCK is not set")
+	}
+
+	return socket, nil
+}
+
+// withAgent connects to the ssh-agent listening on the socket and
+// runs fn with it. The connection is closed once fn returns so that
+// none is kept between two uses, whatever the lifetime of the
+// configuration or the restarts of the agent.
+func withAgent(socket string, fn func(a agent.ExtendedAgent) error) error {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return fmt.Errorf("failed to connect to ssh-agent: err=%s", err)
+	}
+	defer conn.Close()
+
+	return fn(agent.NewClient(conn))
+}
+
+// agentSigners returns the keys and certificates of the ssh-agent
+func agentSigners(socket string) ([]ssh.Signer, error) {
+	signers := []ssh.Signer{}
+
+	err := withAgent(socket, func(a agent.ExtendedAgent) error {
+		keys, err := a.List()
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			pub, err := ssh.ParsePublicKey(key.Blob)
+			if err != nil {
+				return err
+			}
+
+			signers = append(signers, &agentSigner{socket: socket, pub: pub})
+		}
+
+		return nil
+	})
+
+	return signers, err
+}
+
+// agentSigner is a key of the ssh-agent, which is connected to only
+// for the time of a signature
+type agentSigner struct {
+	socket string
+	pub    ssh.PublicKey
+}
+
+func (s *agentSigner) PublicKey() ssh.PublicKey {
+	return s.pub
+}
+
+func (s *agentSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return s.SignWithAlgorithm(rand, data, "")
+}
+
+func (s *agentSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	var sig *ssh.Signature
+
+	err := withAgent(s.socket, func(a agent.ExtendedAgent) error {
+		signers, err := a.Signers()
+		if err != nil {
+			return err
+		}
+
+		for _, signer := range signers {
+			if !bytes.Equal(signer.PublicKey().Marshal(), s.pub.Marshal()) {
+				continue
+			}
+
+			algoSigner, ok := signer.(ssh.AlgorithmSigner)
+			if !ok {
+				return fmt.Errorf("ssh-agent key cannot sign with algorithm %s", algorithm)
+			}
+
+			sig, err = algoSigner.SignWithAlgorithm(rand, data, algorithm)
+
+			return err
+		}
+
+		return fmt.Errorf("key %s is no longer in ssh-agent", ssh.FingerprintSHA256(s.pub))
+	})
+
+	return sig, err
+}
@@ -0,0 +1,166 @@
+package gossh
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+
+	"github.com/gliderlabs/ssh"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAgent(t *testing.T) {
+	data, err := ioutil.ReadFile("./data/id_rsa")
+	require.Nil(t, err)
+
+	key, err := gossh.ParseRawPrivateKey(data)
+	require.Nil(t, err)
+
+	keyring := agent.NewKeyring()
+	err = keyring.Add(agent.AddedKey{PrivateKey: key})
+	require.Nil(t, err)
+
+	dir, err := ioutil.TempDir("", "gossh")
+	require.Nil(t, err)
+
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "agent.sock")
+
+	l, err := net.Listen("unix", socket)
+	require.Nil(t, err)
+
+	defer l.Close()
+
+	// Connections to the agent currently open
+	var opened int32
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			atomic.AddInt32(&opened, 1)
+
+			go func() {
+				agent.ServeAgent(keyring, conn)
+				conn.Close()
+
+				atomic.AddInt32(&opened, -1)
+			}()
+		}
+	}()
+
+	oldSocket := os.Getenv("SSH_AUTH_SOCK")
+	os.Setenv("SSH_AUTH_SOCK", socket)
+
+	defer os.Setenv("SSH_AUTH_SOCK", oldSocket)
+
+	s := &ssh.Server{
+		Addr: ":2222",
+		Handler: func(s ssh.Session) {
+			if !ssh.AgentRequested(s) {
+				fmt.Fprint(s, "no agent")
+				return
+			}
+
+			l, err := ssh.NewAgentListener()
+			if err != nil {
+				fmt.Fprint(s, err)
+				return
+			}
+			defer l.Close()
+
+			go ssh.ForwardAgentConnections(l, s)
+
+			conn, err := net.Dial("unix", l.Addr().String())
+			if err != nil {
+				fmt.Fprint(s, err)
+				return
+			}
+			defer conn.Close()
+
+			keys, err := agent.NewClient(conn).List()
+			if err != nil {
+				fmt.Fprint(s, err)
+				return
+			}
+
+			fmt.Fprintf(s, "%d forwarded keys", len(keys))
+		},
+		PublicKeyHandler: func(ctx ssh.Context, key ssh.PublicKey) bool {
+			data, _ := ioutil.ReadFile("./data/id_rsa.pub")
+			allowed, _, _, _, _ := ssh.ParseAuthorizedKey(data)
+			return ctx.User() == "user" && ssh.KeysEqual(key, allowed)
+		},
+	}
+	go s.ListenAndServe()
+
+	defer s.Close()
+
+	time.Sleep(3 * time.Second)
+
+	testCases := []struct {
+		name   string
+		opts   []Option
+		output interface{}
+	}{
+		{
+			"OKAgent",
+			[]Option{WithAgent()},
+			"no agent",
+		},
+		{
+			"OKAgentForwarding",
+			[]Option{WithAgent(), WithAgentForwarding()},
+			"1 forwarded keys",
+		},
+		{
+			"ErrNoAgentAuth",
+			[]Option{WithAgentForwarding()},
+			"ssh: handshake failed: ssh: unable to authenticate, attempted methods [none], no supported methods remain",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := append([]Option{
+				WithPort(2222),
+				WithUser("user"),
+				WithHostKeyPolicy(InsecureIgnoreHostKey()),
+			}, tc.opts...)
+
+			config, err := NewConfig("localhost", opts...)
+			require.Nil(t, err)
+
+			// The agent is only connected to when used
+			require.Equal(t, int32(0), atomic.LoadInt32(&opened))
+
+			client, err := NewClient(config)
+			if err != nil {
+				require.Equal(t, tc.output, err.Error())
+				return
+			}
+
+			defer client.Close()
+
+			res, err := client.ExecCommand("echo HelloWorld")
+			require.Nil(t, err)
+			require.Equal(t, tc.output, string(res))
+
+			time.Sleep(100 * time.Millisecond)
+			require.Equal(t, int32(0), atomic.LoadInt32(&opened))
+		})
+	}
+}
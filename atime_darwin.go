@@ -0,0 +1,16 @@
+package gossh
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// fileAccessTime returns the access time of the file
+func fileAccessTime(info os.FileInfo) time.Time {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(stat.Atimespec.Unix())
+	}
+
+	return info.ModTime()
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin
+
+package gossh
+
+import (
+	"os"
+	"time"
+)
+
+// fileAccessTime returns the modification time of the file, its access
+// time not being read on this system
+func fileAccessTime(info os.FileInfo) time.Time {
+	return info.ModTime()
+}
@@ -0,0 +1,221 @@
+package gossh
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// BecomeMethod is the command used to execute commands as another
+// user
+type BecomeMethod string
+
+const (
+	// BecomeSudo executes commands with sudo
+	BecomeSudo BecomeMethod = "sudo"
+	// BecomeDoas executes commands with doas
+	BecomeDoas BecomeMethod = "doas"
+	// BecomeSu executes commands with su
+	BecomeSu BecomeMethod = "su"
+)
+
+// Markers written by the wrapped commands to detect the password
+// prompt and the success of the privilege escalation
+const (
+	becomePrompt  = "[gossh-become-password]"
+	becomeSuccess = "GOSSH-BECOME-SUCCESS"
+)
+
+// Become is a privilege escalation: commands and SCP transfers are
+// executed as another user through sudo, doas or su.
+type Become struct {
+	// Method is the escalation command, sudo if empty
+	Method BecomeMethod
+
+	// User is the user to become, root if empty
+	User string
+
+	// Password, if not empty, is sent on stdin when sudo prompts
+	// for it. doas and su read it from a terminal: they can only
+	// be used without password.
+	Password string
+}
+
+// WithBecome executes the command as another user, overriding the
+// privilege escalation of the client
+func WithBecome(become Become) ExecOption {
+	return func(o *execOptions) {
+		o.become = &become
+	}
+}
+
+///////// INTERNAL FUNCTIONS ////////////////////////////
+
+// command returns the command line executing cmd as the user. The
+// wrapped command first writes the success marker on stdout and
+// stderr, so that the escalation is known to be done before its
+// output on each of them. With a pseudo-terminal, stderr is merged
+// into stdout and the marker is only written once.
+func (b *Become) command(cmd string, pty bool) (string, error) {
+	user := b.user()
+
+	marker := "echo " + becomeSuccess + "; "
+	if !pty {
+		marker += "echo " + becomeSuccess + " >&2; "
+	}
+
+	script := shellQuote(marker + cmd)
+
+	switch b.Method {
+	case BecomeSudo, "":
+		if b.Password == "" {
+			return fmt.Sprintf("sudo -n -u %s -- sh -c %s", shellQuote(user), script), nil
+		}
+
+		// With a terminal, the prompt would be mixed with stdout
+		if pty {
+			return "", fmt.Errorf("sudo password cannot be sent with a pseudo-terminal")
+		}
+
+		return fmt.Sprintf("sudo -S -p %s -u %s -- sh -c %s", shellQuote(becomePrompt), shellQuote(user), script), nil
+	case BecomeDoas, BecomeSu:
+		if b.Password != "" {
+			return "", fmt.Errorf("%s reads the password from a terminal: only sudo supports a password", b.Method)
+		}
+
+		if b.Method == BecomeDoas {
+			return fmt.Sprintf("doas -n -u %s sh -c %s", shellQuote(user), script), nil
+		}
+
+		return fmt.Sprintf("su %s -c %s", shellQuote(user), script), nil
+	default:
+		return "", fmt.Errorf("unknown become method: %s", b.Method)
+	}
+}
+
+// escalate waits for the privilege escalation of the command started
+// with the wrapped command line: it answers the password prompt on
+// stdin, then waits for the success marker on stdout. It returns the
+// outputs of the command following the marker, found on each of them
+// apart. The messages of the escalation command are dropped, or
+// returned as error if it fails.
+func (b *Become) escalate(ctx context.Context, stdin io.Writer, stdout, stderr io.Reader) (io.Reader, io.Reader, error) {
+	out := bufio.NewReader(stdout)
+	errReader, errWriter := io.Pipe()
+
+	success := make(chan struct{})
+	abandon := make(chan struct{})
+	failed := make(chan error, 1)
+
+	// Messages written on stderr before the success marker
+	var messages bytes.Buffer
+	stderrClosed := make(chan struct{})
+
+	defer close(abandon)
+
+	go func() {
+		buf := make([]byte, bufferSizeDataFile)
+		marker := []byte(becomeSuccess + "\n")
+		prompts := 0
+
+		for {
+			n, err := stderr.Read(buf)
+
+			messages.Write(buf[:n])
+
+			// Output of the command, following the marker
+			if i := bytes.Index(messages.Bytes(), marker); i >= 0 {
+				errWriter.Write(messages.Bytes()[i+len(marker):])
+
+				if err == nil {
+					_, err = io.Copy(errWriter, stderr)
+				}
+
+				errWriter.CloseWithError(err)
+
+				return
+			}
+
+			if strings.Contains(messages.String(), becomePrompt) {
+				prompts++
+
+				if prompts > 1 {
+					failed <- fmt.Errorf("failed to become %s: incorrect password", b.user())
+					return
+				}
+
+				messages.Reset()
+
+				_, err := fmt.Fprintln(stdin, b.Password)
+				if err != nil {
+					failed <- fmt.Errorf("failed to send password: err=%s", err)
+					return
+				}
+			}
+
+			// Without marker, as with a pseudo-terminal, the command
+			// has no output on stderr
+			if err != nil {
+				close(stderrClosed)
+
+				select {
+				case <-success:
+					errWriter.Close()
+				case <-abandon:
+				}
+
+				return
+			}
+		}
+	}()
+
+	marker := make(chan error, 1)
+
+	go func() {
+		for {
+			line, err := out.ReadString('\n')
+			if err != nil {
+				marker <- err
+				return
+			}
+
+			if strings.TrimSpace(line) == becomeSuccess {
+				marker <- nil
+				return
+			}
+		}
+	}()
+
+	select {
+	case err := <-marker:
+		if err != nil {
+			// The command ended, as its stderr
+			select {
+			case <-stderrClosed:
+				return nil, nil, fmt.Errorf("failed to become %s: %s", b.user(), strings.TrimSpace(messages.String()))
+			case err := <-failed:
+				return nil, nil, err
+			}
+		}
+
+		close(success)
+
+		return out, errReader, nil
+	case err := <-failed:
+		return nil, nil, err
+	case <-ctx.Done():
+		return nil, nil, context.Cause(ctx)
+	}
+}
+
+// user returns the user to become
+func (b *Become) user() string {
+	if b.User == "" {
+		return "root"
+	}
+
+	return b.User
+}
@@ -0,0 +1,218 @@
+package gossh
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSudo behaves as sudo -S -p <prompt> or sudo -n, accepting the
+// password "secret", and exports the user to become as SUDO_AS
+const fakeSudo = `#!/bin/sh
+while [ "$1" != "--" ]; do
+	case "$1" in
+	-S) ask=1 ;;
+	-n) ask= ;;
+	-p) shift; prompt="$1" ;;
+	-u) shift; SUDO_AS="$1" ;;
+	esac
+	shift
+done
+shift
+
+if [ -z "$ask" ]; then
+	echo "sudo: a password is required" >&2
+	exit 1
+fi
+
+for i in 1 2; do
+	printf '%s' "$prompt" >&2
+	read -r password
+	if [ "$password" = "secret" ]; then
+		export SUDO_AS
+		exec "$@"
+	fi
+	echo "Sorry, try again." >&2
+done
+
+exit 1
+`
+
+// shellHandler executes the commands with sh, the directory bin
+// being first in PATH
+func shellHandler(bin string) ssh.Handler {
+	return func(s ssh.Session) {
+		cmd := exec.Command("sh", "-c", s.RawCommand())
+		cmd.Env = append(os.Environ(), s.Environ()...)
+		cmd.Env = append(cmd.Env, "PATH="+bin+":"+os.Getenv("PATH"))
+		cmd.Stdout = s
+		cmd.Stderr = s.Stderr()
+
+		// As sshd, do not wait for the end of stdin once the
+		// command exits
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			s.Exit(1)
+			return
+		}
+
+		go func() {
+			defer stdin.Close()
+			io.Copy(stdin, s)
+		}()
+
+		err = cmd.Run()
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			s.Exit(exitErr.ExitCode())
+			return
+		}
+
+		s.Exit(0)
+	}
+}
+
+func TestBecome(t *testing.T) {
+	bin, err := ioutil.TempDir("", "gossh")
+	require.Nil(t, err)
+
+	defer os.RemoveAll(bin)
+
+	err = ioutil.WriteFile(filepath.Join(bin, "sudo"), []byte(fakeSudo), 0755)
+	require.Nil(t, err)
+
+	s := &ssh.Server{
+		Addr:    ":2222",
+		Handler: shellHandler(bin),
+		PasswordHandler: func(ctx ssh.Context, password string) bool {
+			return ctx.User() == "user" && password == "pass"
+		},
+	}
+	go s.ListenAndServe()
+
+	defer s.Close()
+
+	time.Sleep(3 * time.Second)
+
+	testCases := []struct {
+		name   string
+		become Become
+		output interface{}
+	}{
+		{
+			"OKPassword",
+			Become{Password: "secret"},
+			"root:HelloWorld\n",
+		},
+		{
+			"OKUser",
+			Become{Method: BecomeSudo, User: "deploy", Password: "secret"},
+			"deploy:HelloWorld\n",
+		},
+		{
+			"ErrPassword",
+			Become{Password: "wrong"},
+			"failed to become root: incorrect password",
+		},
+		{
+			"ErrPasswordRequired",
+			Become{},
+			"failed to become root: sudo: a password is required",
+		},
+		{
+			"ErrDoasPassword",
+			Become{Method: BecomeDoas, Password: "secret"},
+			"doas reads the password from a terminal: only sudo supports a password",
+		},
+	}
+
+	config, err := NewClientConfigWithUserPass("user", "pass", "localhost", 2222, false)
+	require.Nil(t, err)
+
+	client, err := NewClient(config)
+	require.Nil(t, err)
+
+	defer client.Close()
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := client.Run("echo $SUDO_AS:$(cat)", WithBecome(tc.become), WithStdin(strings.NewReader("HelloWorld")))
+			if err != nil {
+				require.Equal(t, tc.output, err.Error())
+				return
+			}
+
+			require.Equal(t, tc.output, string(res.Stdout))
+			require.Empty(t, res.Stderr)
+		})
+	}
+
+	// SCP transfers executed by the become user
+	dir, err := ioutil.TempDir("", "gossh")
+	require.Nil(t, err)
+
+	defer os.RemoveAll(dir)
+
+	client.SetBecome(&Become{Password: "secret"})
+
+	goroutines := runtime.NumGoroutine()
+
+	for i := 0; i < 20; i++ {
+		err = client.SCPSendBytes([]byte("HelloWorld"), dir+"/become.txt", "0644")
+		require.Nil(t, err)
+	}
+
+	// No routine left behind by the transfers
+	time.Sleep(500 * time.Millisecond)
+	require.LessOrEqual(t, runtime.NumGoroutine(), goroutines+2)
+
+	content, err := ioutil.ReadFile(dir + "/become.txt")
+	require.Nil(t, err)
+	require.Equal(t, "HelloWorld", string(content))
+
+	res, err := client.ExecCommand("echo $SUDO_AS")
+	require.Nil(t, err)
+	require.Equal(t, "root\n", string(res))
+}
+
+func TestBecomeStderr(t *testing.T) {
+	become := &Become{}
+
+	// The command writes on stderr right after the marker
+	for i := 0; i < 200; i++ {
+		stdoutReader, stdoutWriter := io.Pipe()
+		stderrReader, stderrWriter := io.Pipe()
+
+		go func() {
+			io.WriteString(stdoutWriter, becomeSuccess+"\n")
+			stdoutWriter.Close()
+		}()
+
+		go func() {
+			io.WriteString(stderrWriter, becomeSuccess+"\n")
+			io.WriteString(stderrWriter, "error\n")
+			stderrWriter.Close()
+		}()
+
+		out, e, err := become.escalate(context.Background(), ioutil.Discard, stdoutReader, stderrReader)
+		require.Nil(t, err)
+
+		stdout, err := ioutil.ReadAll(out)
+		require.Nil(t, err)
+		require.Equal(t, "", string(stdout))
+
+		stderr, err := ioutil.ReadAll(e)
+		require.Nil(t, err)
+		require.Equal(t, "error\n", string(stderr))
+	}
+}
@@ -1,37 +1,83 @@
 package gossh
 
 import (
-	//"fmt"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	log "github.com/uthng/golog"
 
 	"golang.org/x/crypto/ssh"
 )
 
+// Maximum duration of the transfers started by the SCP methods
+// without context
+const scpTimeout = 15 * time.Minute
+
+// Time left to the remote process to exit after SIGTERM, when a
+// command or a transfer is aborted, before it is sent SIGKILL
+var abortGracePeriod = 5 * time.Second
+
+// ErrClientClosed is returned by the operations of a closed client
+var ErrClientClosed = errors.New("gossh: client is closed")
+
 // Client encapsulates ssh client
 type Client struct {
-	client *ssh.Client
+	config *Config
 	logger *log.Logger
+
+	// Current connection, replaced when it is re-established. mu is
+	// never held while redialing: reconnecting serializes the
+	// reconnections instead.
+	mu           sync.Mutex
+	conn         *connection
+	reconnecting chan struct{}
+
+	// done is closed when the client is closed or its connection
+	// is lost without reconnect policy, err being the reason
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
+
+	// Privilege escalation of commands and transfers, none if nil
+	become *Become
+
+	// Protocol of the transfers, and whether the remote machine has
+	// scp once checked by TransferAuto
+	transfer Transfer
+	hasSCP   *bool
 }
 
 // NewClient initializes a ssh client following
-// authentication configuration
+// authentication configuration. If the configuration has jump hosts,
+// the connection is tunneled through them.
 func NewClient(config *Config) (*Client, error) {
-	c := &Client{}
-
-	client, err := ssh.Dial("tcp", config.Host+":"+strconv.Itoa(config.Port), config.ClientConfig)
-	if err != nil {
-		return nil, err
-	}
-
-	c.client = client
+	return DialContext(context.Background(), config)
+}
 
-	c.logger = log.NewLogger()
-	c.logger.SetVerbosity(log.NONE)
+// DialContext initializes a ssh client as NewClient. If ctx is done
+// before the connection is established, it is aborted and ctx.Err()
+// is returned.
+func DialContext(ctx context.Context, config *Config) (*Client, error) {
+	return newClient(ctx, config, nil)
+}
 
-	return c, nil
+// NewClientFromConn initializes a ssh client over an existing
+// network connection to the host of the configuration or,
+// if it has jump hosts, to the first one. With a reconnect policy,
+// the lost connection is re-established with the dialer of the
+// configuration.
+func NewClientFromConn(conn net.Conn, config *Config) (*Client, error) {
+	return newClient(context.Background(), config, conn)
 }
 
 // SetVerbosity sets log level
@@ -44,117 +90,510 @@ func (c *Client) DisableLogColor(level int) {
 	c.logger.DisableColor()
 }
 
+// Close closes the connection to the host and its jump hosts.
+// Running commands and transfers are aborted and return
+// ErrClientClosed.
+func (c *Client) Close() error {
+	c.shutdown(nil)
+	return nil
+}
+
+// Done returns a channel closed when the client is closed or,
+// without reconnect policy, when its connection is lost
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Wait blocks until the client is done and returns why: nil if it
+// was closed with Close, the error having ended the connection
+// otherwise.
+func (c *Client) Wait() error {
+	<-c.done
+	return c.err
+}
+
+// IsAlive returns true if the client is not closed and its current
+// connection is established. With a reconnect policy, a lost
+// connection is re-established by the next command or transfer.
+func (c *Client) IsAlive() bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.conn.alive()
+}
+
 // ExecCommand executes a shell command on remote machine
 func (c *Client) ExecCommand(cmd string) ([]byte, error) {
-	session, err := c.client.NewSession()
+	return c.ExecCommandContext(context.Background(), cmd)
+}
+
+// ExecCommandContext executes a shell command on remote machine
+// and returns its combined stdout and stderr. If ctx is done before
+// the command completes, the remote process is sent SIGTERM, the
+// session is closed and ctx.Err() is returned.
+func (c *Client) ExecCommandContext(ctx context.Context, cmd string) ([]byte, error) {
+	var output syncBuffer
+
+	command, err := c.StartContext(ctx, cmd, WithStdout(&output), WithStderr(&output))
 	if err != nil {
 		return nil, err
 	}
-	defer session.Close()
 
-	return session.CombinedOutput(cmd)
+	_, err = command.Wait()
+
+	// Exit errors are returned as by ssh.Session
+	var exitErr *ExitError
+	if errors.As(err, &exitErr) {
+		err = exitErr.err
+	}
+
+	return output.Bytes(), err
+}
+
+// SetBecome sets the privilege escalation wrapping the commands and
+// the SCP transfers, as another user with sudo for example. nil
+// disables it. Commands can override it with WithBecome.
+func (c *Client) SetBecome(become *Become) {
+	c.become = become
+}
+
+// SetTransfer sets the protocol used by the SCP methods to transfer
+// files, TransferSCP by default
+func (c *Client) SetTransfer(transfer Transfer) {
+	c.transfer = transfer
 }
 
 // SCPBytes sends content in bytes to remote machine and save it
 // in a file with the given path
-func (c *Client) SCPSendBytes(content []byte, destFile, mode string) error {
-	c.checkLogEnvVars()
+func (c *Client) SCPSendBytes(content []byte, destFile, mode string, opts ...SCPOption) error {
+	ctx, cancel := context.WithTimeout(context.Background(), scpTimeout)
+	defer cancel()
 
-	session, err := c.client.NewSession()
-	if err != nil {
-		return nil
-	}
-	defer session.Close()
+	return c.SCPSendBytesContext(ctx, content, destFile, mode, opts...)
+}
 
-	scpSession, err := newSCPSession(c, session)
-	if err != nil {
-		return err
+// SCPSendBytesContext is SCPSendBytes aborting the transfer
+// when ctx is done
+func (c *Client) SCPSendBytesContext(ctx context.Context, content []byte, destFile, mode string, opts ...SCPOption) error {
+	return c.copyFiles(ctx, opts, func(s *scpSession) error {
+		return s.SendBytes(content, destFile, mode)
+	}, func(s *sftpSession) error {
+		return s.SendBytes(content, destFile, mode)
+	})
+}
+
+// SCPSendReader sends the size bytes read from r to remote machine
+// and save them in a file with the given path. The content is
+// streamed, without being held in memory. If size is negative,
+// the content is uploaded as set by WithUnknownSize.
+func (c *Client) SCPSendReader(r io.Reader, size int64, destFile, mode string, opts ...SCPOption) error {
+	ctx, cancel := context.WithTimeout(context.Background(), scpTimeout)
+	defer cancel()
+
+	return c.SCPSendReaderContext(ctx, r, size, destFile, mode, opts...)
+}
+
+// SCPSendReaderContext is SCPSendReader aborting the transfer
+// when ctx is done
+func (c *Client) SCPSendReaderContext(ctx context.Context, r io.Reader, size int64, destFile, mode string, opts ...SCPOption) error {
+	if size < 0 {
+		useSFTP, err := c.useSFTP(ctx)
+		if err != nil {
+			return err
+		}
+
+		if !useSFTP {
+			return c.sendUnknownSize(ctx, r, destFile, mode, opts)
+		}
 	}
 
-	return scpSession.SendBytes(content, destFile, mode)
+	return c.copyFiles(ctx, opts, func(s *scpSession) error {
+		return s.SendReader(r, size, destFile, mode)
+	}, func(s *sftpSession) error {
+		return s.SendReader(r, size, destFile, mode)
+	})
 }
 
 // SCPFile sends a file to remote machine
-func (c *Client) SCPSendFile(srcFile, destFile, mode string) error {
-	c.checkLogEnvVars()
+func (c *Client) SCPSendFile(srcFile, destFile, mode string, opts ...SCPOption) error {
+	ctx, cancel := context.WithTimeout(context.Background(), scpTimeout)
+	defer cancel()
+
+	return c.SCPSendFileContext(ctx, srcFile, destFile, mode, opts...)
+}
+
+// SCPSendFileContext is SCPSendFile aborting the transfer
+// when ctx is done
+func (c *Client) SCPSendFileContext(ctx context.Context, srcFile, destFile, mode string, opts ...SCPOption) error {
+	return c.copyFiles(ctx, opts, func(s *scpSession) error {
+		return s.SendFile(srcFile, destFile, mode)
+	}, func(s *sftpSession) error {
+		return s.SendFile(srcFile, destFile, mode)
+	})
+}
+
+// SCPDir sends recursively a directory to remote machine.
+// Mode is only applied for the 1st directory. All files/folders
+// inside the srcDir will preserve the same mode on remote machine
+func (c *Client) SCPSendDir(srcDir, destDir, mode string, opts ...SCPOption) error {
+	ctx, cancel := context.WithTimeout(context.Background(), scpTimeout)
+	defer cancel()
 
-	session, err := c.client.NewSession()
+	return c.SCPSendDirContext(ctx, srcDir, destDir, mode, opts...)
+}
+
+// SCPSendDirContext is SCPSendDir aborting the transfer
+// when ctx is done
+func (c *Client) SCPSendDirContext(ctx context.Context, srcDir, destDir, mode string, opts ...SCPOption) error {
+	return c.copyFiles(ctx, opts, func(s *scpSession) error {
+		return s.SendDir(srcDir, destDir, mode)
+	}, func(s *sftpSession) error {
+		return s.SendDir(srcDir, destDir, mode)
+	})
+}
+
+// SCPGetFile gets srcFile from remote machine and save in destDir.
+// srcFile must be a regular file.
+// destFile is the local regular in which srcFile's content will be stored;.
+// If destFile does not exists, it will be created. If it is an existing
+// directory, srcFile is stored into it with the same name.
+func (c *Client) SCPGetFile(srcFile, destFile string, opts ...SCPOption) error {
+	ctx, cancel := context.WithTimeout(context.Background(), scpTimeout)
+	defer cancel()
+
+	return c.SCPGetFileContext(ctx, srcFile, destFile, opts...)
+}
+
+// SCPGetFileContext is SCPGetFile aborting the transfer
+// when ctx is done
+func (c *Client) SCPGetFileContext(ctx context.Context, srcFile, destFile string, opts ...SCPOption) error {
+	return c.copyFiles(ctx, opts, func(s *scpSession) error {
+		return s.GetFile(srcFile, destFile)
+	}, func(s *sftpSession) error {
+		return s.GetFile(srcFile, destFile)
+	})
+}
+
+// SCPGetBytes gets srcFile from remote machine and returns its
+// content
+func (c *Client) SCPGetBytes(srcFile string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), scpTimeout)
+	defer cancel()
+
+	return c.SCPGetBytesContext(ctx, srcFile)
+}
+
+// SCPGetBytesContext is SCPGetBytes aborting the transfer
+// when ctx is done
+func (c *Client) SCPGetBytesContext(ctx context.Context, srcFile string) ([]byte, error) {
+	var content bytes.Buffer
+
+	_, err := c.SCPGetToWriterContext(ctx, srcFile, &content)
 	if err != nil {
-		return nil
+		return nil, err
 	}
-	defer session.Close()
 
-	scpSession, err := newSCPSession(c, session)
-	if err != nil {
+	return content.Bytes(), nil
+}
+
+// SCPGetToWriter gets srcFile from remote machine and writes its
+// content to w as it arrives, without local file. The mode and the
+// size of the remote file are returned.
+func (c *Client) SCPGetToWriter(srcFile string, w io.Writer) (*SCPFileInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), scpTimeout)
+	defer cancel()
+
+	return c.SCPGetToWriterContext(ctx, srcFile, w)
+}
+
+// SCPGetToWriterContext is SCPGetToWriter aborting the transfer
+// when ctx is done
+func (c *Client) SCPGetToWriterContext(ctx context.Context, srcFile string, w io.Writer) (*SCPFileInfo, error) {
+	var info *SCPFileInfo
+
+	err := c.copyFiles(ctx, nil, func(s *scpSession) error {
+		var err error
+
+		info, err = s.GetToWriter(srcFile, w)
+
 		return err
-	}
+	}, func(s *sftpSession) error {
+		var err error
 
-	return scpSession.SendFile(srcFile, destFile, mode)
+		info, err = s.GetToWriter(srcFile, w)
+
+		return err
+	})
+
+	return info, err
 }
 
-// SCPDir sends recursively a directory to remote machine.
-// Mode is only applied for the 1st directory. All files/folders
-// inside the srcDir will preserve the same mode on remote machine
-func (c *Client) SCPSendDir(srcDir, destDir, mode string) error {
-	c.checkLogEnvVars()
+// SCPGetDir gets srcDir from remote machine and save in destDir.
+// srcDir must be a folder. destDir is the local folder in which
+// all files or subfolders inside srcDir will be stored.
+// If destDir does not exists, it will be created.
+func (c *Client) SCPGetDir(srcDir, destDir string, opts ...SCPOption) error {
+	ctx, cancel := context.WithTimeout(context.Background(), scpTimeout)
+	defer cancel()
+
+	return c.SCPGetDirContext(ctx, srcDir, destDir, opts...)
+}
+
+// SCPGetDirContext is SCPGetDir aborting the transfer
+// when ctx is done
+func (c *Client) SCPGetDirContext(ctx context.Context, srcDir, destDir string, opts ...SCPOption) error {
+	return c.copyFiles(ctx, opts, func(s *scpSession) error {
+		return s.GetDir(srcDir, destDir)
+	}, func(s *sftpSession) error {
+		return s.GetDir(srcDir, destDir)
+	})
+}
+
+/////////////// INTERNAL FUNCTIONS //////////////////////////
 
-	session, err := c.client.NewSession()
+// newClient connects to the host of the configuration, over the
+// given connection if not nil
+func newClient(ctx context.Context, config *Config, conn net.Conn) (*Client, error) {
+	c := &Client{
+		config:       config,
+		done:         make(chan struct{}),
+		reconnecting: make(chan struct{}, 1),
+	}
+
+	cn, err := newConnection(ctx, config, conn)
 	if err != nil {
-		return nil
+		return nil, err
 	}
-	defer session.Close()
 
-	scpSession, err := newSCPSession(c, session)
+	c.conn = cn
+
+	// Without reconnect policy, the client ends with its connection
+	if config.reconnect == nil {
+		go func() {
+			<-cn.done
+			c.shutdown(cn.err)
+		}()
+	}
+
+	c.logger = log.NewLogger()
+	c.logger.SetVerbosity(log.NONE)
+
+	return c, nil
+}
+
+// copyFiles runs the transfer with the protocol set by SetTransfer
+// and the given options
+func (c *Client) copyFiles(ctx context.Context, opts []SCPOption, scpFn func(s *scpSession) error, sftpFn func(s *sftpSession) error) error {
+	o := &scpOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	useSFTP, err := c.useSFTP(ctx)
 	if err != nil {
 		return err
 	}
 
-	return scpSession.SendDir(srcDir, destDir, mode)
+	if useSFTP {
+		return c.sftp(ctx, func(s *sftpSession) error {
+			s.preserveTimes = o.preserveTimes
+			return sftpFn(s)
+		})
+	}
+
+	return c.scp(ctx, func(s *scpSession) error {
+		s.preserveTimes = o.preserveTimes
+		return scpFn(s)
+	})
 }
 
-// SCPGetFile gets srcFile from remote machine and save in destDir.
-// srcFile must be a regular file.
-// destFile is the local regular in which srcFile's content will be stored;.
-// If destFile does not exists, it will be created.
-func (c *Client) SCPGetFile(srcFile, destFile string) error {
-	c.checkLogEnvVars()
+// sendUnknownSize uploads the content of r, whose size is unknown,
+// with scp once spooled to a temporary file, or with cat
+func (c *Client) sendUnknownSize(ctx context.Context, r io.Reader, destFile, mode string, opts []SCPOption) error {
+	o := &scpOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
 
-	session, err := c.client.NewSession()
+	if mode == "" {
+		mode = "0755"
+	}
+
+	if o.unknownSize == UnknownSizeCat {
+		perm, err := parseMode(mode)
+		if err != nil {
+			return err
+		}
+
+		dest := shellQuotePath(destFile)
+
+		res, err := c.RunContext(ctx, fmt.Sprintf("cat > %s && chmod %04o %s", dest, perm, dest), WithStdin(r))
+		if err != nil && res != nil && len(res.Stderr) > 0 {
+			return fmt.Errorf("failed to write remote file: err=%s", strings.TrimSpace(string(res.Stderr)))
+		}
+
+		return err
+	}
+
+	spool, err := ioutil.TempFile("", "gossh")
 	if err != nil {
-		return nil
+		return fmt.Errorf("failed to create spool file: err=%s", err)
+	}
+
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	size, err := io.Copy(spool, r)
+	if err != nil {
+		return fmt.Errorf("failed to spool content: err=%s", err)
 	}
-	defer session.Close()
 
-	scpSession, err := newSCPSession(c, session)
+	_, err = spool.Seek(0, io.SeekStart)
 	if err != nil {
 		return err
 	}
 
-	return scpSession.GetFile(srcFile, destFile)
+	return c.copyFiles(ctx, opts, func(s *scpSession) error {
+		return s.SendReader(spool, size, destFile, mode)
+	}, func(s *sftpSession) error {
+		return s.SendReader(spool, size, destFile, mode)
+	})
 }
 
-// SCPGetDir gets srcDir from remote machine and save in destDir.
-// srcDir must be a folder. destDir is the local folder in which
-// all files or subfolders inside srcDir will be stored.
-// If destDir does not exists, it will be created.
-func (c *Client) SCPGetDir(srcDir, destDir string) error {
+// useSFTP returns true if the transfers use sftp. With TransferAuto,
+// the presence of scp on the remote machine is checked once.
+func (c *Client) useSFTP(ctx context.Context) (bool, error) {
+	switch c.transfer {
+	case TransferSCP:
+		return false, nil
+	case TransferSFTP:
+		return true, nil
+	}
+
+	if c.become != nil {
+		return false, nil
+	}
+
+	c.mu.Lock()
+	hasSCP := c.hasSCP
+	c.mu.Unlock()
+
+	if hasSCP == nil {
+		_, err := c.RunContext(ctx, "command -v scp")
+
+		var exitErr *ExitError
+		if err != nil && !errors.As(err, &exitErr) {
+			return false, err
+		}
+
+		found := err == nil
+		hasSCP = &found
+
+		c.mu.Lock()
+		c.hasSCP = hasSCP
+		c.mu.Unlock()
+	}
+
+	return !*hasSCP, nil
+}
+
+// scp opens a new session and runs the given transfer in it
+func (c *Client) scp(ctx context.Context, fn func(s *scpSession) error) error {
 	c.checkLogEnvVars()
 
-	session, err := c.client.NewSession()
+	ctx, cancel := c.context(ctx)
+	defer cancel()
+
+	session, err := c.newSession(ctx)
 	if err != nil {
-		return nil
+		return err
 	}
 	defer session.Close()
 
-	scpSession, err := newSCPSession(c, session)
+	scpSession, err := newSCPSession(ctx, c, session)
 	if err != nil {
 		return err
 	}
 
-	return scpSession.GetDir(srcDir, destDir)
+	return fn(scpSession)
 }
 
-/////////////// INTERNAL FUNCTIONS //////////////////////////
+// shutdown ends the client for the given reason and closes its
+// connection. Only the first call has an effect.
+func (c *Client) shutdown(reason error) {
+	c.closeOnce.Do(func() {
+		// done is closed first to abort a reconnection in progress
+		c.err = reason
+		close(c.done)
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		c.conn.close(ErrClientClosed)
+	})
+}
+
+// context returns a context derived from ctx, canceled with the
+// cause ErrClientClosed when the client is closed
+func (c *Client) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(ctx)
+
+	go func() {
+		select {
+		case <-c.done:
+			cancel(ErrClientClosed)
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, func() {
+		cancel(context.Canceled)
+	}
+}
+
+// waitSession waits for the end of the command started in the
+// session, or aborts it when ctx is done
+func waitSession(ctx context.Context, session *ssh.Session) error {
+	done := make(chan error, 1)
+
+	go func() {
+		done <- session.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		abortSession(session, done)
+		return context.Cause(ctx)
+	}
+}
+
+// abortSession sends SIGTERM to the remote process, then SIGKILL if
+// it has not exited, as reported by done, within abortGracePeriod,
+// and closes the session. Servers which do not handle signals hang
+// up the process when the session is closed.
+func abortSession(session *ssh.Session, done <-chan error) {
+	err := session.Signal(ssh.SIGTERM)
+	if err == nil {
+		timer := time.NewTimer(abortGracePeriod)
+		defer timer.Stop()
+
+		select {
+		case <-done:
+		case <-timer.C:
+			session.Signal(ssh.SIGKILL)
+		}
+	}
+
+	session.Close()
+}
 
 func (c *Client) checkLogEnvVars() {
 	verbosity := os.Getenv("GOSSH_VERBOSITY")
@@ -167,3 +606,25 @@ func (c *Client) checkLogEnvVars() {
 		c.logger.DisableColor()
 	}
 }
+
+// syncBuffer is a buffer safe to write from the goroutines copying
+// the stdout and the stderr of a session
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+// Bytes returns a copy of the content written so far
+func (b *syncBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return append([]byte{}, b.buf.Bytes()...)
+}
@@ -1,11 +1,16 @@
 package gossh
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"testing"
@@ -495,3 +500,547 @@ func TestSCPGetDir(t *testing.T) {
 		})
 	}
 }
+
+func TestJumpHosts(t *testing.T) {
+	var forwarded []string
+
+	s := &ssh.Server{
+		Addr: ":2222",
+		Handler: func(s ssh.Session) {
+			if s.Command()[0] == "scp" {
+				sessionHandler(s)
+				return
+			}
+
+			fmt.Fprintf(s, "%s", strings.Join(s.Command(), " "))
+		},
+		PasswordHandler: func(ctx ssh.Context, password string) bool {
+			return ctx.User() == "user" && password == "pass"
+		},
+	}
+	go s.ListenAndServe()
+
+	defer s.Close()
+
+	bastion := &ssh.Server{
+		Addr: ":2223",
+		ChannelHandlers: map[string]ssh.ChannelHandler{
+			"session":      ssh.DefaultSessionHandler,
+			"direct-tcpip": ssh.DirectTCPIPHandler,
+		},
+		LocalPortForwardingCallback: func(ctx ssh.Context, host string, port uint32) bool {
+			forwarded = append(forwarded, fmt.Sprintf("%s:%d", host, port))
+			return true
+		},
+		PasswordHandler: func(ctx ssh.Context, password string) bool {
+			return ctx.User() == "jump" && password == "jumppass"
+		},
+	}
+	go bastion.ListenAndServe()
+
+	defer bastion.Close()
+
+	time.Sleep(3 * time.Second)
+
+	testCases := []struct {
+		name   string
+		jumps  []string
+		output interface{}
+	}{
+		{
+			"OKOneJump",
+			[]string{"jumppass"},
+			[]string{"localhost:2222"},
+		},
+		{
+			"OKTwoJumps",
+			[]string{"jumppass", "jumppass"},
+			[]string{"localhost:2223", "localhost:2222"},
+		},
+		{
+			"ErrJumpAuth",
+			[]string{"wrong"},
+			"failed to connect to jump host localhost:2223: err=ssh: handshake failed: ssh: unable to authenticate, attempted methods [none password], no supported methods remain",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			forwarded = nil
+
+			opts := []Option{WithPort(2222), WithUser("user"), WithPassword("pass"), WithHostKeyPolicy(InsecureIgnoreHostKey())}
+
+			for _, password := range tc.jumps {
+				jump, err := NewClientConfigWithUserPass("jump", password, "localhost", 2223, false)
+				require.Nil(t, err)
+
+				opts = append(opts, WithJumpHost(jump))
+			}
+
+			config, err := NewConfig("localhost", opts...)
+			require.Nil(t, err)
+
+			client, err := NewClient(config)
+			if err != nil {
+				require.Equal(t, tc.output, err.Error())
+				return
+			}
+
+			require.Equal(t, tc.output, forwarded)
+
+			cmd := "echo HelloWorld"
+			res, err := client.ExecCommand(cmd)
+			require.Nil(t, err)
+			require.Equal(t, cmd, string(res))
+
+			dir, err := ioutil.TempDir("", "gossh")
+			require.Nil(t, err)
+
+			defer os.RemoveAll(dir)
+
+			src, err := filepath.Abs("./data/lorem.txt")
+			require.Nil(t, err)
+
+			err = client.SCPGetFile(src, dir+"/lorem.txt")
+			require.Nil(t, err)
+
+			expected, err := ioutil.ReadFile(src)
+			require.Nil(t, err)
+
+			gotten, err := ioutil.ReadFile(dir + "/lorem.txt")
+			require.Nil(t, err)
+			require.Equal(t, expected, gotten)
+		})
+	}
+}
+
+func TestContext(t *testing.T) {
+	signals := make(chan ssh.Signal, 1)
+
+	s := &ssh.Server{
+		Addr: ":2222",
+		Handler: func(s ssh.Session) {
+			// Commands hang until a signal is received or the session
+			// is closed, scp does not answer
+			if s.Command()[0] == "sleep" || s.Command()[0] == "scp" {
+				sigs := make(chan ssh.Signal, 1)
+				s.Signals(sigs)
+
+				select {
+				case sig := <-sigs:
+					signals <- sig
+				case <-s.Context().Done():
+				}
+
+				return
+			}
+
+			fmt.Fprintf(s, "%s", strings.Join(s.Command(), " "))
+		},
+		PasswordHandler: func(ctx ssh.Context, password string) bool {
+			return ctx.User() == "user" && password == "pass"
+		},
+	}
+	go s.ListenAndServe()
+
+	defer s.Close()
+
+	time.Sleep(3 * time.Second)
+
+	config, err := NewClientConfigWithUserPass("user", "pass", "localhost", 2222, false)
+	require.Nil(t, err)
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = DialContext(canceled, config)
+	require.Equal(t, context.Canceled, err)
+
+	client, err := DialContext(context.Background(), config)
+	require.Nil(t, err)
+
+	testCases := []struct {
+		name   string
+		cmd    string
+		output interface{}
+	}{
+		{
+			"OK",
+			"echo HelloWorld",
+			"echo HelloWorld",
+		},
+		{
+			"ErrDeadline",
+			"sleep 60",
+			context.DeadlineExceeded,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			res, err := client.ExecCommandContext(ctx, tc.cmd)
+			if err != nil {
+				require.Equal(t, tc.output, err)
+				require.Equal(t, ssh.SIGTERM, <-signals)
+				return
+			}
+
+			require.Equal(t, tc.output, string(res))
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	err = client.SCPSendBytesContext(ctx, []byte("content"), "/tmp/gossh_context", "0644")
+	require.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestClose(t *testing.T) {
+	s := &ssh.Server{
+		Addr: ":2222",
+		Handler: func(s ssh.Session) {
+			if s.Command()[0] == "sleep" {
+				<-s.Context().Done()
+				return
+			}
+
+			fmt.Fprintf(s, "%s", strings.Join(s.Command(), " "))
+		},
+		PasswordHandler: func(ctx ssh.Context, password string) bool {
+			return ctx.User() == "user" && password == "pass"
+		},
+	}
+	go s.ListenAndServe()
+
+	time.Sleep(3 * time.Second)
+
+	config, err := NewClientConfigWithUserPass("user", "pass", "localhost", 2222, false)
+	require.Nil(t, err)
+
+	client, err := NewClient(config)
+	require.Nil(t, err)
+	require.True(t, client.IsAlive())
+
+	// Running command aborted by Close
+	errCh := make(chan error, 1)
+
+	go func() {
+		_, err := client.ExecCommand("sleep 60")
+		errCh <- err
+	}()
+
+	time.Sleep(500 * time.Millisecond)
+
+	err = client.Close()
+	require.Nil(t, err)
+	require.Equal(t, ErrClientClosed, <-errCh)
+
+	<-client.Done()
+	require.Nil(t, client.Wait())
+	require.False(t, client.IsAlive())
+
+	_, err = client.ExecCommand("echo HelloWorld")
+	require.Equal(t, ErrClientClosed, err)
+
+	// Connection closed by the server
+	client, err = NewClient(config)
+	require.Nil(t, err)
+
+	s.Close()
+
+	select {
+	case <-client.Done():
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "client not done after the connection is closed")
+	}
+
+	require.NotNil(t, client.Wait())
+	require.False(t, client.IsAlive())
+
+	_, err = client.ExecCommand("echo HelloWorld")
+	require.True(t, strings.HasPrefix(err.Error(), "connection to localhost:2222 lost: err="))
+}
+
+func TestSCPPreserveTimes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gossh")
+	require.Nil(t, err)
+
+	defer os.RemoveAll(dir)
+
+	err = os.MkdirAll(dir+"/local/sub", 0755)
+	require.Nil(t, err)
+
+	err = ioutil.WriteFile(dir+"/local/sub/file", []byte("HelloWorld"), 0644)
+	require.Nil(t, err)
+
+	// Recent access time, not updated by the reads with relatime
+	modTime := time.Date(2020, 3, 27, 11, 27, 25, 0, time.UTC)
+	accessTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	// Reads may update the access times
+	resetTimes := func(t *testing.T) {
+		for _, p := range []string{"/local/sub/file", "/local/sub", "/local"} {
+			err := os.Chtimes(dir+p, accessTime, modTime)
+			require.Nil(t, err)
+		}
+	}
+
+	s := &ssh.Server{
+		Addr:    ":2222",
+		Handler: shellHandler(""),
+		SubsystemHandlers: map[string]ssh.SubsystemHandler{
+			"sftp": sftpHandler,
+		},
+		PasswordHandler: func(ctx ssh.Context, password string) bool {
+			return ctx.User() == "user" && password == "pass"
+		},
+	}
+	go s.ListenAndServe()
+
+	defer s.Close()
+
+	time.Sleep(3 * time.Second)
+
+	config, err := NewClientConfigWithUserPass("user", "pass", "localhost", 2222, false)
+	require.Nil(t, err)
+
+	client, err := NewClient(config)
+	require.Nil(t, err)
+
+	defer client.Close()
+
+	requireTimes := func(t *testing.T, file string, accessTime time.Time) {
+		info, err := os.Stat(file)
+		require.Nil(t, err)
+		require.True(t, modTime.Equal(info.ModTime()), "%s: mtime %s", file, info.ModTime())
+		require.True(t, accessTime.Equal(fileAccessTime(info)), "%s: atime %s", file, fileAccessTime(info))
+	}
+
+	testCases := []struct {
+		name     string
+		transfer Transfer
+	}{
+		{"OKSCP", TransferSCP},
+		{"OKSFTP", TransferSFTP},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client.SetTransfer(tc.transfer)
+			resetTimes(t)
+
+			remote := filepath.Join(dir, tc.name)
+
+			// The sftp server of the tests gives the modification
+			// time as access time
+			getAccessTime := accessTime
+			if tc.transfer == TransferSFTP {
+				getAccessTime = modTime
+			}
+
+			err := os.Mkdir(remote, 0755)
+			require.Nil(t, err)
+
+			err = client.SCPSendFile(dir+"/local/sub/file", remote+"/file", "", WithPreserveTimes())
+			require.Nil(t, err)
+			requireTimes(t, remote+"/file", accessTime)
+
+			resetTimes(t)
+
+			err = client.SCPSendDir(dir+"/local", remote, "", WithPreserveTimes())
+			require.Nil(t, err)
+			requireTimes(t, remote+"/local", accessTime)
+			requireTimes(t, remote+"/local/sub", accessTime)
+			requireTimes(t, remote+"/local/sub/file", accessTime)
+
+			err = client.SCPGetFile(remote+"/file", remote+"/got/file", WithPreserveTimes())
+			require.Nil(t, err)
+			requireTimes(t, remote+"/got/file", getAccessTime)
+
+			err = client.SCPGetDir(remote+"/local", remote+"/got", WithPreserveTimes())
+			require.Nil(t, err)
+			requireTimes(t, remote+"/got/local", getAccessTime)
+			requireTimes(t, remote+"/got/local/sub", getAccessTime)
+			requireTimes(t, remote+"/got/local/sub/file", getAccessTime)
+
+			// Times not kept by default
+			err = client.SCPSendFile(dir+"/local/sub/file", remote+"/now", "")
+			require.Nil(t, err)
+
+			info, err := os.Stat(remote + "/now")
+			require.Nil(t, err)
+			require.True(t, time.Since(info.ModTime()) < time.Minute)
+		})
+	}
+}
+
+func TestSCPSendReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gossh")
+	require.Nil(t, err)
+
+	defer os.RemoveAll(dir)
+
+	s := &ssh.Server{
+		Addr:    ":2222",
+		Handler: shellHandler(""),
+		SubsystemHandlers: map[string]ssh.SubsystemHandler{
+			"sftp": sftpHandler,
+		},
+		PasswordHandler: func(ctx ssh.Context, password string) bool {
+			return ctx.User() == "user" && password == "pass"
+		},
+	}
+	go s.ListenAndServe()
+
+	defer s.Close()
+
+	time.Sleep(3 * time.Second)
+
+	config, err := NewClientConfigWithUserPass("user", "pass", "localhost", 2222, false)
+	require.Nil(t, err)
+
+	client, err := NewClient(config)
+	require.Nil(t, err)
+
+	defer client.Close()
+
+	// Content larger than the buffers, generated on the fly
+	content := strings.Repeat("HelloWorld\n", 10000)
+
+	testCases := []struct {
+		name     string
+		transfer Transfer
+		size     int64
+		opts     []SCPOption
+		output   interface{}
+	}{
+		{"OKKnownSize", TransferSCP, int64(len(content)), nil, nil},
+		{"OKSpool", TransferSCP, -1, nil, nil},
+		{"OKCat", TransferSCP, -1, []SCPOption{WithUnknownSize(UnknownSizeCat)}, nil},
+		{"OKSFTPUnknownSize", TransferSFTP, -1, nil, nil},
+		{
+			"ErrShortReader",
+			TransferSCP,
+			int64(len(content)) + 1,
+			nil,
+			"error while writing content file: err=unexpected EOF",
+		},
+		{
+			"ErrCat",
+			TransferSCP,
+			-1,
+			[]SCPOption{WithUnknownSize(UnknownSizeCat)},
+			"failed to write remote file: err=",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client.SetTransfer(tc.transfer)
+
+			dest := dir + "/" + tc.name
+			if tc.name == "ErrCat" {
+				dest = dir + "/missing/file"
+			}
+
+			r, w := io.Pipe()
+
+			go func() {
+				io.WriteString(w, content)
+				w.Close()
+			}()
+
+			err := client.SCPSendReader(r, tc.size, dest, "0640", tc.opts...)
+			if tc.output != nil {
+				// Errors of the remote shell vary
+				require.NotNil(t, err)
+				require.True(t, strings.HasPrefix(err.Error(), tc.output.(string)), err.Error())
+
+				r.Close()
+
+				return
+			}
+
+			require.Nil(t, err)
+
+			gotten, err := ioutil.ReadFile(dest)
+			require.Nil(t, err)
+			require.Equal(t, content, string(gotten))
+
+			info, err := os.Stat(dest)
+			require.Nil(t, err)
+			require.Equal(t, os.FileMode(0640), info.Mode().Perm())
+		})
+	}
+}
+
+func TestSCPGetBytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gossh")
+	require.Nil(t, err)
+
+	defer os.RemoveAll(dir)
+
+	// Binary content ending with the byte closing the data
+	content := append(bytes.Repeat([]byte("Hello\x00World\n"), 1000), '\x00')
+
+	err = ioutil.WriteFile(dir+"/file bin", content, 0640)
+	require.Nil(t, err)
+
+	s := &ssh.Server{
+		Addr:    ":2222",
+		Handler: shellHandler(""),
+		SubsystemHandlers: map[string]ssh.SubsystemHandler{
+			"sftp": sftpHandler,
+		},
+		PasswordHandler: func(ctx ssh.Context, password string) bool {
+			return ctx.User() == "user" && password == "pass"
+		},
+	}
+	go s.ListenAndServe()
+
+	defer s.Close()
+
+	time.Sleep(3 * time.Second)
+
+	config, err := NewClientConfigWithUserPass("user", "pass", "localhost", 2222, false)
+	require.Nil(t, err)
+
+	client, err := NewClient(config)
+	require.Nil(t, err)
+
+	defer client.Close()
+
+	testCases := []struct {
+		name     string
+		transfer Transfer
+	}{
+		{"OKSCP", TransferSCP},
+		{"OKSFTP", TransferSFTP},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client.SetTransfer(tc.transfer)
+
+			gotten, err := client.SCPGetBytes(dir + "/file bin")
+			require.Nil(t, err)
+			require.Equal(t, content, gotten)
+
+			hash := sha256.New()
+
+			info, err := client.SCPGetToWriter(dir+"/file bin", hash)
+			require.Nil(t, err)
+			require.Equal(t, &SCPFileInfo{Name: "file bin", Mode: 0640, Size: int64(len(content))}, info)
+
+			expected := sha256.Sum256(content)
+			require.Equal(t, expected[:], hash.Sum(nil))
+
+			_, err = client.SCPGetBytes(dir + "/missing")
+			require.NotNil(t, err)
+		})
+	}
+}
@@ -1,13 +1,11 @@
 package gossh
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"os"
-	"path/filepath"
-	"strconv"
-	"strings"
+	"os/user"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 )
@@ -17,206 +15,276 @@ type Config struct {
 	Host         string
 	Port         int
 	ClientConfig *ssh.ClientConfig
+
+	// Intermediate hosts (bastions) to go through, in order, to
+	// reach Host, each with its own authentication and host key
+	// policy
+	JumpHosts []*Config
+
+	// Dialer establishes the network connection to Host or, with jump
+	// hosts, to the first one. A net.Dialer is used if nil.
+	Dialer Dialer
+
+	// Private keys, along with their certificates, to load
+	// for the public key authentication
+	identities []identity
+	// Signers given directly for the public key authentication
+	signers []ssh.Signer
+	// Passphrases of the encrypted private keys
+	passphraseProvider PassphraseProvider
+	hostKeyPolicy      HostKeyPolicy
+
+	// Socket of the running ssh-agent, whose keys are offered if
+	// agentAuth is true and which is forwarded to sessions if
+	// forwardAgent is true. The agent is only connected to when used.
+	agentSocket  string
+	agentAuth    bool
+	forwardAgent bool
+
+	// keepalive@openssh.com requests are sent every keepaliveInterval
+	// if not 0. The connection is considered dead after
+	// keepaliveMaxMissed requests without reply.
+	keepaliveInterval  time.Duration
+	keepaliveMaxMissed int
+	// Policy re-establishing lost connections, none if nil
+	reconnect *ReconnectPolicy
 }
 
-// NewClientConfigWithKeyFile returns a configuration
-// corresponding to a simple configuration with private key
-func NewClientConfigWithKeyFile(username string, sshKey string, host string, port int, checkHostKey bool) (*Config, error) {
-	var hostKey ssh.PublicKey
+// PassphraseProvider returns the passphrase decrypting
+// the given private key file
+type PassphraseProvider func(keyFile string) ([]byte, error)
+
+// identity is a private key file with an optional certificate
+// signed by a CA
+type identity struct {
+	keyFile  string
+	certFile string
+}
 
+// NewConfig returns a configuration for the given host built
+// with the given options.
+//
+// By default, the port is 22, the user is the current local user and
+// host keys are verified against $HOME/.ssh/known_hosts.
+// Authentication methods are tried in the order of the options,
+// public keys first.
+func NewConfig(host string, opts ...Option) (*Config, error) {
 	c := &Config{
-		Host: host,
-		Port: port,
+		Host:          host,
+		Port:          22,
+		ClientConfig:  &ssh.ClientConfig{},
+		hostKeyPolicy: KnownHosts(),
 	}
 
-	// Read private key
-	key, err := ioutil.ReadFile(sshKey)
-	if err != nil {
-		return nil, err
+	for _, opt := range opts {
+		err := opt(c)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	// Create the Signer for this private key.
-	signer, err := ssh.ParsePrivateKey(key)
-	if err != nil {
-		return nil, err
+	if c.ClientConfig.User == "" {
+		if u, err := user.Current(); err == nil {
+			c.ClientConfig.User = u.Username
+		}
 	}
 
-	if checkHostKey {
-		//arr := strings.Split(host, ":")
-		hostKey, err = getHostKey(host, strconv.Itoa(port))
-		if err != nil {
-			return nil, err
-		}
+	signers, err := c.loadSigners()
+	if err != nil {
+		return nil, err
 	}
 
-	c.ClientConfig = &ssh.ClientConfig{
-		User: username,
-		Auth: []ssh.AuthMethod{
-			//ssh.Password("chrYsal1s-adm1n"),
-			//ssh.PublicKeyFile("/home/uthng/.ssh/ssh_servers"),
-			ssh.PublicKeys(signer),
-		},
-		//HostKeyCallback: ssh.FixedHostKey(hostKey),
-		//HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		//HostKeyCallback: nil,
+	if len(signers) > 0 || c.agentAuth {
+		c.ClientConfig.Auth = append([]ssh.AuthMethod{ssh.PublicKeysCallback(c.publicKeys(signers))}, c.ClientConfig.Auth...)
 	}
 
-	if checkHostKey {
-		c.ClientConfig.HostKeyCallback = ssh.FixedHostKey(hostKey)
-	} else {
-		c.ClientConfig.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	err = c.SetHostKeyPolicy(c.hostKeyPolicy)
+	if err != nil {
+		return nil, err
 	}
 
 	return c, nil
 }
 
+// NewClientConfigWithKeyFile returns a configuration
+// corresponding to a simple configuration with private key.
+// Options such as WithPassphrase can be added for encrypted keys.
+func NewClientConfigWithKeyFile(username string, sshKey string, host string, port int, checkHostKey bool, opts ...Option) (*Config, error) {
+	return NewConfig(host, append([]Option{
+		WithPort(port),
+		WithUser(username),
+		WithKeyFile(sshKey),
+		WithHostKeyPolicy(newHostKeyPolicy(checkHostKey)),
+	}, opts...)...)
+}
+
 // NewClientConfigWithSignedPubKeyFile returns a configuration
 // corresponding to the configuration using private key along with
 // a signed public key.
-func NewClientConfigWithSignedPubKeyFile(username, sshKey, signedPubKey, host string, port int, checkHostKey bool) (*Config, error) {
-	var hostKey ssh.PublicKey
+// Options such as WithPassphrase can be added for encrypted keys.
+func NewClientConfigWithSignedPubKeyFile(username, sshKey, signedPubKey, host string, port int, checkHostKey bool, opts ...Option) (*Config, error) {
+	return NewConfig(host, append([]Option{
+		WithPort(port),
+		WithUser(username),
+		WithCertificate(sshKey, signedPubKey),
+		WithHostKeyPolicy(newHostKeyPolicy(checkHostKey)),
+	}, opts...)...)
+}
 
-	c := &Config{
-		Host: host,
-		Port: port,
-	}
+// NewClientConfigWithUserPass returns a configuration
+// with given parameters
+func NewClientConfigWithUserPass(username string, password string, host string, port int, checkHostKey bool, opts ...Option) (*Config, error) {
+	return NewConfig(host, append([]Option{
+		WithPort(port),
+		WithUser(username),
+		WithPassword(password),
+		WithHostKeyPolicy(newHostKeyPolicy(checkHostKey)),
+	}, opts...)...)
+}
 
-	// Read private key
-	key, err := ioutil.ReadFile(sshKey)
-	if err != nil {
-		return nil, err
-	}
+// KeyboardInteractivePassword returns a keyboard-interactive
+// challenge answering the given password to all questions
+// whose answer is not echoed, as the password prompt of PAM.
+// Other questions get empty answers.
+func KeyboardInteractivePassword(password string) ssh.KeyboardInteractiveChallenge {
+	return func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+		answers := make([]string, len(questions))
+
+		for i := range questions {
+			if !echos[i] {
+				answers[i] = password
+			}
+		}
 
-	// Create the Signer for this private key.
-	signer, err := ssh.ParsePrivateKey(key)
-	if err != nil {
-		return nil, err
+		return answers, nil
 	}
+}
 
-	// Load the certificate
-	cert, err := ioutil.ReadFile(signedPubKey)
+// SetHostKeyPolicy sets the policy used to verify the key
+// presented by the remote machine during the handshake.
+func (c *Config) SetHostKeyPolicy(policy HostKeyPolicy) error {
+	callback, algos, err := policy.HostKeyCallback(c.Host, c.Port)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	pubKey, _, _, _, err := ssh.ParseAuthorizedKey(cert)
-	if err != nil {
-		return nil, err
-	}
+	c.ClientConfig.HostKeyCallback = callback
+	c.ClientConfig.HostKeyAlgorithms = algos
 
-	certSigner, err := ssh.NewCertSigner(pubKey.(*ssh.Certificate), signer)
-	if err != nil {
-		return nil, err
+	return nil
+}
+
+/////////// PRIVATE FUNCTIONS ////////////////////////////
+
+// newHostKeyPolicy returns the host key policy corresponding to
+// checkHostKey. If it is true, the key presented by the remote machine
+// is verified against $HOME/.ssh/known_hosts.
+func newHostKeyPolicy(checkHostKey bool) HostKeyPolicy {
+	if !checkHostKey {
+		return InsecureIgnoreHostKey()
 	}
 
-	if checkHostKey {
-		//arr := strings.Split(host, ":")
-		hostKey, err = getHostKey(host, strconv.Itoa(port))
+	return KnownHosts()
+}
+
+// loadSigners returns the signers given directly followed by the
+// ones of the private keys to load
+func (c *Config) loadSigners() ([]ssh.Signer, error) {
+	signers := append([]ssh.Signer{}, c.signers...)
+
+	for _, id := range c.identities {
+		signer, err := loadIdentity(id, c.passphraseProvider)
 		if err != nil {
 			return nil, err
 		}
-	}
-
-	c.ClientConfig = &ssh.ClientConfig{
-		User: username,
-		Auth: []ssh.AuthMethod{
-			//ssh.Password("chrYsal1s-adm1n"),
-			//ssh.PublicKeyFile("/home/uthng/.ssh/ssh_servers"),
-			ssh.PublicKeys(certSigner),
-		},
-		//HostKeyCallback: ssh.FixedHostKey(hostKey),
-		//HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		//HostKeyCallback: nil,
-	}
 
-	if checkHostKey {
-		c.ClientConfig.HostKeyCallback = ssh.FixedHostKey(hostKey)
-	} else {
-		c.ClientConfig.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+		signers = append(signers, signer)
 	}
 
-	return c, nil
+	return signers, nil
 }
 
-// NewClientConfigWithUserPass returns a configuration
-// with given parameters
-func NewClientConfigWithUserPass(username string, password string, host string, port int, checkHostKey bool) (*Config, error) {
-	var hostKey ssh.PublicKey
-	var err error
-
-	c := &Config{
-		Host: host,
-		Port: port,
-	}
+// publicKeys returns the callback listing the keys offered for the
+// public key authentication: the given signers followed by the keys
+// and certificates of the ssh-agent if it is used.
+func (c *Config) publicKeys(signers []ssh.Signer) func() ([]ssh.Signer, error) {
+	return func() ([]ssh.Signer, error) {
+		if !c.agentAuth {
+			return signers, nil
+		}
 
-	if checkHostKey {
-		//arr := strings.Split(host, ":")
-		hostKey, err = getHostKey(host, strconv.Itoa(port))
+		agentSigners, err := agentSigners(c.agentSocket)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("failed to list ssh-agent keys: err=%s", err)
 		}
+
+		return append(append([]ssh.Signer{}, signers...), agentSigners...), nil
 	}
+}
 
-	c.ClientConfig = &ssh.ClientConfig{
-		User: username,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(password),
-		},
+// loadIdentity reads the private key and, if any, the certificate
+// of the identity and returns the corresponding signer.
+// Encrypted private keys are decrypted with the passphrase returned
+// by the given provider.
+func loadIdentity(id identity, provider PassphraseProvider) (ssh.Signer, error) {
+	// Read private key
+	key, err := ioutil.ReadFile(id.keyFile)
+	if err != nil {
+		return nil, err
 	}
 
-	if checkHostKey {
-		c.ClientConfig.HostKeyCallback = ssh.FixedHostKey(hostKey)
-	} else {
-		c.ClientConfig.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	// Create the Signer for this private key.
+	signer, err := parsePrivateKey(id.keyFile, key, provider)
+	if err != nil {
+		return nil, err
 	}
 
-	return c, nil
-}
+	if id.certFile == "" {
+		return signer, nil
+	}
 
-/////////// PRIVATE FUNCTIONS ////////////////////////////
-func getHostKey(host, port string) (ssh.PublicKey, error) {
-	// $HOME/.ssh/known_hosts
-	file, err := os.Open(filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts"))
+	// Load the certificate
+	content, err := ioutil.ReadFile(id.certFile)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
 
-	var hostport string
-	if port == "22" {
-		// standard port assumes 22
-		// 192.168.10.53 ssh-rsa AAAAB3Nza...vguvx+81N1xaw==
-		hostport = host
-	} else {
-		// non-standard port(s)
-		// [ssh.example.com]:1999,[93.184.216.34]:1999 ssh-rsa AAAAB3Nza...vguvx+81N1xaw==
-		hostport = "[" + host + "]:" + port
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey(content)
+	if err != nil {
+		return nil, err
 	}
 
-	scanner := bufio.NewScanner(file)
-	var hostKey ssh.PublicKey
+	cert, ok := pubKey.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a certificate", id.certFile)
+	}
 
-	for scanner.Scan() {
-		fields := strings.Split(scanner.Text(), " ")
-		if len(fields) != 3 {
-			continue
-		}
+	return ssh.NewCertSigner(cert, signer)
+}
 
-		if strings.Contains(fields[0], hostport) {
-			var err error
+// parsePrivateKey parses the private key in PEM or OpenSSH format.
+// If it is encrypted, the passphrase is asked to the provider.
+func parsePrivateKey(keyFile string, key []byte, provider PassphraseProvider) (ssh.Signer, error) {
+	var missingErr *ssh.PassphraseMissingError
 
-			hostKey, _, _, _, err = ssh.ParseAuthorizedKey(scanner.Bytes())
-			if err != nil {
-				return nil, err
-			}
+	signer, err := ssh.ParsePrivateKey(key)
+	if !errors.As(err, &missingErr) {
+		return signer, err
+	}
 
-			break // scanning line by line, first occurrence will be returned
-		}
+	if provider == nil {
+		return nil, fmt.Errorf("private key %s is encrypted but no passphrase is given", keyFile)
 	}
 
-	if hostKey == nil {
-		return nil, fmt.Errorf("No hostkey for %s", host+":"+port)
+	passphrase, err := provider(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err = ssh.ParsePrivateKeyWithPassphrase(key, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt private key %s: err=%s", keyFile, err)
 	}
 
-	return hostKey, nil
+	return signer, nil
 }
@@ -0,0 +1,332 @@
+package gossh
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/gliderlabs/ssh"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewConfig(t *testing.T) {
+	s := &ssh.Server{
+		Addr: ":2222",
+		Handler: func(s ssh.Session) {
+			fmt.Fprintf(s, "%s", strings.Join(s.Command(), " "))
+		},
+		PasswordHandler: func(ctx ssh.Context, password string) bool {
+			return ctx.User() == "user" && password == "pass"
+		},
+		PublicKeyHandler: func(ctx ssh.Context, key ssh.PublicKey) bool {
+			data, _ := ioutil.ReadFile("./data/id_rsa.pub")
+			allowed, _, _, _, _ := ssh.ParseAuthorizedKey(data)
+			return ctx.User() == "user" && ssh.KeysEqual(key, allowed)
+		},
+	}
+	go s.ListenAndServe()
+
+	defer s.Close()
+
+	time.Sleep(3 * time.Second)
+
+	testCases := []struct {
+		name   string
+		opts   []Option
+		output interface{}
+	}{
+		{
+			"OKKeyFile",
+			[]Option{WithKeyFile("./data/id_rsa")},
+			nil,
+		},
+		{
+			"OKKeyRejectedThenPassword",
+			[]Option{WithKeyFile("./data/ca"), WithPassword("pass")},
+			nil,
+		},
+		{
+			"OKSeveralKeys",
+			[]Option{WithKeyFile("./data/ca"), WithKeyFile("./data/id_rsa")},
+			nil,
+		},
+		{
+			"ErrAuth",
+			[]Option{WithKeyFile("./data/ca"), WithPassword("wrong")},
+			"ssh: handshake failed: ssh: unable to authenticate, attempted methods [none publickey password], no supported methods remain",
+		},
+		{
+			"ErrKeyFile",
+			[]Option{WithKeyFile("./data/notfound")},
+			"open ./data/notfound: no such file or directory",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := append([]Option{
+				WithPort(2222),
+				WithUser("user"),
+				WithHostKeyPolicy(InsecureIgnoreHostKey()),
+				WithTimeout(5 * time.Second),
+			}, tc.opts...)
+
+			config, err := NewConfig("localhost", opts...)
+			if err != nil {
+				require.Equal(t, tc.output, err.Error())
+				return
+			}
+
+			client, err := NewClient(config)
+			if err != nil {
+				require.Equal(t, tc.output, err.Error())
+				return
+			}
+
+			require.Nil(t, tc.output)
+
+			cmd := "echo HelloWorld"
+			res, err := client.ExecCommand(cmd)
+			require.Nil(t, err)
+			require.Equal(t, cmd, string(res))
+		})
+	}
+}
+
+func TestEncryptedKeyFile(t *testing.T) {
+	data, err := ioutil.ReadFile("./data/id_rsa")
+	require.Nil(t, err)
+
+	key, err := gossh.ParseRawPrivateKey(data)
+	require.Nil(t, err)
+
+	dir, err := ioutil.TempDir("", "gossh")
+	require.Nil(t, err)
+
+	defer os.RemoveAll(dir)
+
+	// Private key encrypted in OpenSSH format
+	block, err := gossh.MarshalPrivateKeyWithPassphrase(key, "", []byte("passphrase"))
+	require.Nil(t, err)
+
+	opensshKey := filepath.Join(dir, "id_rsa_openssh")
+	err = ioutil.WriteFile(opensshKey, pem.EncodeToMemory(block), 0600)
+	require.Nil(t, err)
+
+	// Private key encrypted in legacy PEM format
+	block, err = x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key.(*rsa.PrivateKey)), []byte("passphrase"), x509.PEMCipherAES128)
+	require.Nil(t, err)
+
+	pemKey := filepath.Join(dir, "id_rsa_pem")
+	err = ioutil.WriteFile(pemKey, pem.EncodeToMemory(block), 0600)
+	require.Nil(t, err)
+
+	s := &ssh.Server{
+		Addr: ":2222",
+		Handler: func(s ssh.Session) {
+			fmt.Fprintf(s, "%s", strings.Join(s.Command(), " "))
+		},
+		PublicKeyHandler: func(ctx ssh.Context, key ssh.PublicKey) bool {
+			data, _ := ioutil.ReadFile("./data/id_rsa.pub")
+			allowed, _, _, _, _ := ssh.ParseAuthorizedKey(data)
+
+			if cert, ok := key.(*gossh.Certificate); ok {
+				key = cert.Key
+			}
+
+			return ctx.User() == "user" && ssh.KeysEqual(key, allowed)
+		},
+	}
+	go s.ListenAndServe()
+
+	defer s.Close()
+
+	time.Sleep(3 * time.Second)
+
+	testCases := []struct {
+		name   string
+		config func() (*Config, error)
+		output interface{}
+	}{
+		{
+			"OKOpenSSHPassphrase",
+			func() (*Config, error) {
+				return NewClientConfigWithKeyFile("user", opensshKey, "localhost", 2222, false, WithPassphrase([]byte("passphrase")))
+			},
+			nil,
+		},
+		{
+			"OKPEMPassphraseProvider",
+			func() (*Config, error) {
+				return NewClientConfigWithKeyFile("user", pemKey, "localhost", 2222, false, WithPassphraseProvider(func(keyFile string) ([]byte, error) {
+					return []byte("passphrase"), nil
+				}))
+			},
+			nil,
+		},
+		{
+			"OKSignedPubKey",
+			func() (*Config, error) {
+				return NewClientConfigWithSignedPubKeyFile("user", opensshKey, "./data/id_rsa-cert.pub", "localhost", 2222, false, WithPassphrase([]byte("passphrase")))
+			},
+			nil,
+		},
+		{
+			"ErrNoPassphrase",
+			func() (*Config, error) {
+				return NewClientConfigWithKeyFile("user", opensshKey, "localhost", 2222, false)
+			},
+			"private key " + opensshKey + " is encrypted but no passphrase is given",
+		},
+		{
+			"ErrWrongPassphrase",
+			func() (*Config, error) {
+				return NewClientConfigWithKeyFile("user", pemKey, "localhost", 2222, false, WithPassphrase([]byte("wrong")))
+			},
+			"failed to decrypt private key " + pemKey + ": err=x509: decryption password incorrect",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config, err := tc.config()
+			if err != nil {
+				require.Equal(t, tc.output, err.Error())
+				return
+			}
+
+			client, err := NewClient(config)
+			require.Nil(t, err)
+			require.Nil(t, tc.output)
+
+			cmd := "echo HelloWorld"
+			res, err := client.ExecCommand(cmd)
+			require.Nil(t, err)
+			require.Equal(t, cmd, string(res))
+		})
+	}
+}
+
+func TestKeyboardInteractive(t *testing.T) {
+	data, err := ioutil.ReadFile("./data/id_rsa.pub")
+	require.Nil(t, err)
+
+	allowed, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	require.Nil(t, err)
+
+	// Asks a password and an OTP code
+	challenge := func(conn gossh.ConnMetadata, client gossh.KeyboardInteractiveChallenge) (*gossh.Permissions, error) {
+		answers, err := client("", "Two steps", []string{"Password: ", "Code: "}, []bool{false, true})
+		if err != nil {
+			return nil, err
+		}
+
+		if conn.User() != "user" || len(answers) != 2 || answers[0] != "pass" || answers[1] != "123456" {
+			return nil, fmt.Errorf("permission denied")
+		}
+
+		return nil, nil
+	}
+
+	s := &ssh.Server{
+		Addr: ":2222",
+		Handler: func(s ssh.Session) {
+			fmt.Fprintf(s, "%s", strings.Join(s.Command(), " "))
+		},
+		KeyboardInteractiveHandler: func(ctx ssh.Context, challenger gossh.KeyboardInteractiveChallenge) bool {
+			return ctx.User() == "kbd" && challenger != nil
+		},
+		ServerConfigCallback: func(ctx ssh.Context) *gossh.ServerConfig {
+			return &gossh.ServerConfig{
+				// "publickey,keyboard-interactive" for user
+				PublicKeyCallback: func(conn gossh.ConnMetadata, key gossh.PublicKey) (*gossh.Permissions, error) {
+					if conn.User() != "user" || !ssh.KeysEqual(key, allowed) {
+						return nil, fmt.Errorf("permission denied")
+					}
+
+					return nil, &gossh.PartialSuccessError{
+						Next: gossh.ServerAuthCallbacks{
+							KeyboardInteractiveCallback: challenge,
+						},
+					}
+				},
+			}
+		},
+	}
+	go s.ListenAndServe()
+
+	defer s.Close()
+
+	time.Sleep(3 * time.Second)
+
+	answers := func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+		if len(questions) != 2 {
+			return nil, fmt.Errorf("unexpected questions: %q", questions)
+		}
+
+		return []string{"pass", "123456"}, nil
+	}
+
+	testCases := []struct {
+		name   string
+		opts   []Option
+		output interface{}
+	}{
+		{
+			"OKKeyboardInteractive",
+			[]Option{WithUser("kbd"), WithKeyboardInteractive(KeyboardInteractivePassword("pass"))},
+			nil,
+		},
+		{
+			"OKPublicKeyThenKeyboardInteractive",
+			[]Option{WithUser("user"), WithKeyFile("./data/id_rsa"), WithKeyboardInteractive(answers)},
+			nil,
+		},
+		{
+			"ErrWrongAnswers",
+			[]Option{WithUser("user"), WithKeyFile("./data/id_rsa"), WithKeyboardInteractive(KeyboardInteractivePassword("pass"))},
+			"ssh: handshake failed: ssh: unable to authenticate, attempted methods [none keyboard-interactive], no supported methods remain",
+		},
+		{
+			"ErrPublicKeyOnly",
+			[]Option{WithUser("user"), WithKeyFile("./data/id_rsa")},
+			"ssh: handshake failed: ssh: unable to authenticate, attempted methods [none], no supported methods remain",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := append([]Option{
+				WithPort(2222),
+				WithHostKeyPolicy(InsecureIgnoreHostKey()),
+			}, tc.opts...)
+
+			config, err := NewConfig("localhost", opts...)
+			require.Nil(t, err)
+
+			client, err := NewClient(config)
+			if err != nil {
+				require.Equal(t, tc.output, err.Error())
+				return
+			}
+
+			require.Nil(t, tc.output)
+
+			cmd := "echo HelloWorld"
+			res, err := client.ExecCommand(cmd)
+			require.Nil(t, err)
+			require.Equal(t, cmd, string(res))
+		})
+	}
+}
@@ -0,0 +1,303 @@
+package gossh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+const (
+	// Keepalive requests without reply after which the connection is
+	// considered dead, as ServerAliveCountMax of OpenSSH
+	defaultKeepaliveMaxMissed = 3
+
+	defaultReconnectBackoff    = time.Second
+	defaultReconnectMaxBackoff = time.Minute
+)
+
+// ReconnectPolicy defines how a lost connection is re-established.
+// It is dialed again with the configuration of the client, waiting
+// between the failed attempts a delay doubled after each of them.
+type ReconnectPolicy struct {
+	// MaxAttempts is the number of dials before giving up,
+	// unlimited if 0
+	MaxAttempts int
+
+	// Backoff is the delay after the first failed attempt,
+	// 1 second if 0
+	Backoff time.Duration
+
+	// MaxBackoff is the maximum delay between two attempts,
+	// 1 minute if 0
+	MaxBackoff time.Duration
+}
+
+///////// INTERNAL FUNCTIONS ////////////////////////////
+
+// connection is an established connection to the host and its jump
+// hosts. done is closed once it is lost or closed, err being the
+// reason.
+type connection struct {
+	client      *ssh.Client
+	jumpClients []*ssh.Client
+
+	done chan struct{}
+	once sync.Once
+	err  error
+}
+
+// newConnection connects to the host of the configuration, over the
+// given connection if not nil, and watches the connection
+func newConnection(ctx context.Context, config *Config, conn net.Conn) (*connection, error) {
+	client, jumpClients, err := dial(ctx, config, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.forwardAgent {
+		err = agent.ForwardToRemote(client, config.agentSocket)
+		if err != nil {
+			closeClients(append(jumpClients, client))
+			return nil, err
+		}
+	}
+
+	cn := &connection{
+		client:      client,
+		jumpClients: jumpClients,
+		done:        make(chan struct{}),
+	}
+
+	go func() {
+		err := client.Wait()
+		if err == nil {
+			err = io.EOF
+		}
+
+		cn.close(err)
+	}()
+
+	if config.keepaliveInterval > 0 {
+		go cn.keepalive(config.keepaliveInterval, config.keepaliveMaxMissed)
+	}
+
+	return cn, nil
+}
+
+// close closes the connection, recording the reason if it is the
+// first call
+func (cn *connection) close(err error) {
+	cn.once.Do(func() {
+		cn.err = err
+		close(cn.done)
+
+		closeClients(append(cn.jumpClients, cn.client))
+	})
+}
+
+// alive returns false once the connection is lost or closed
+func (cn *connection) alive() bool {
+	select {
+	case <-cn.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// keepalive sends keepalive requests every interval and closes the
+// connection once maxMissed successive requests are left without
+// reply, or if a request fails
+func (cn *connection) keepalive(interval time.Duration, maxMissed int) {
+	// Replies of requests timed out may arrive later: they are
+	// dropped if nobody waits for them
+	replies := make(chan error, 1)
+	missed := 0
+
+	for {
+		select {
+		case <-cn.done:
+			return
+		case <-time.After(interval):
+		}
+
+		go func() {
+			// Servers not knowing the request reply false, it
+			// still proves the connection is alive
+			_, _, err := cn.client.SendRequest("keepalive@openssh.com", true, nil)
+
+			select {
+			case replies <- err:
+			default:
+			}
+		}()
+
+		select {
+		case <-cn.done:
+			return
+		case err := <-replies:
+			if err != nil {
+				cn.close(fmt.Errorf("keepalive failed: err=%s", err))
+				return
+			}
+
+			missed = 0
+		case <-time.After(interval):
+			missed++
+
+			if missed >= maxMissed {
+				cn.close(fmt.Errorf("no reply to %d keepalive requests", missed))
+				return
+			}
+		}
+	}
+}
+
+// newSession opens a new session on the current connection,
+// re-establishing it first if it is lost and the client has
+// a reconnect policy
+func (c *Client) newSession(ctx context.Context) (*ssh.Session, error) {
+	for attempt := 0; ; attempt++ {
+		conn, err := c.connection(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		session, err := conn.client.NewSession()
+		if err == nil {
+			return session, nil
+		}
+
+		// The connection was lost but it has not been detected yet
+		if errors.Is(err, io.EOF) {
+			conn.close(err)
+		}
+
+		// Only retry once, on a new connection
+		if conn.alive() || c.config.reconnect == nil || attempt > 0 {
+			return nil, err
+		}
+	}
+}
+
+// connection returns the current connection, re-established if it
+// is lost and the client has a reconnect policy
+func (c *Client) connection(ctx context.Context) (*connection, error) {
+	conn, err := c.currentConnection()
+	if conn != nil || err != nil {
+		return conn, err
+	}
+
+	// Only one reconnection at a time, the others wait for it
+	select {
+	case c.reconnecting <- struct{}{}:
+	case <-ctx.Done():
+		return nil, context.Cause(ctx)
+	}
+	defer func() { <-c.reconnecting }()
+
+	// The connection may have been re-established in the meantime
+	conn, err = c.currentConnection()
+	if conn != nil || err != nil {
+		return conn, err
+	}
+
+	c.mu.Lock()
+	lost := c.conn
+	c.mu.Unlock()
+
+	conn, err = c.reconnect(ctx, c.config.reconnect, lost.err)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.conn = conn
+
+	// The client may have been closed during the reconnection
+	select {
+	case <-c.done:
+		conn.close(ErrClientClosed)
+		return nil, ErrClientClosed
+	default:
+	}
+
+	return conn, nil
+}
+
+// currentConnection returns the current connection if it is alive.
+// It returns nil without error if it is lost and must be
+// re-established.
+func (c *Client) currentConnection() (*connection, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	select {
+	case <-c.done:
+		if c.err == nil {
+			return nil, ErrClientClosed
+		}
+	default:
+	}
+
+	if c.conn.alive() {
+		return c.conn, nil
+	}
+
+	if c.config.reconnect == nil {
+		return nil, fmt.Errorf("connection to %s lost: err=%s", c.config.address(), c.conn.err)
+	}
+
+	return nil, nil
+}
+
+// reconnect dials the host of the configuration again following the
+// given policy, the previous connection being lost for reason
+func (c *Client) reconnect(ctx context.Context, policy *ReconnectPolicy, reason error) (*connection, error) {
+	backoff := policy.Backoff
+	if backoff <= 0 {
+		backoff = defaultReconnectBackoff
+	}
+
+	maxBackoff := policy.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = defaultReconnectMaxBackoff
+	}
+
+	for attempt := 1; ; attempt++ {
+		c.logger.Infow("Reconnecting", "address", c.config.address(), "attempt", attempt, "reason", reason)
+
+		conn, err := newConnection(ctx, c.config, nil)
+		if err == nil {
+			return conn, nil
+		}
+
+		if ctx.Err() != nil {
+			return nil, context.Cause(ctx)
+		}
+
+		if policy.MaxAttempts > 0 && attempt >= policy.MaxAttempts {
+			return nil, fmt.Errorf("failed to reconnect to %s after %d attempts: err=%s", c.config.address(), attempt, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, context.Cause(ctx)
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
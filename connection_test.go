@@ -0,0 +1,241 @@
+package gossh
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+
+	"github.com/stretchr/testify/require"
+)
+
+// frozenConn simulates a connection silently dropped by a NAT once
+// frozen: writes are discarded and reads block until it is closed
+type frozenConn struct {
+	net.Conn
+
+	mu     sync.Mutex
+	frozen bool
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (c *frozenConn) freeze() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.frozen = true
+}
+
+func (c *frozenConn) isFrozen() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.frozen
+}
+
+func (c *frozenConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if c.isFrozen() {
+		<-c.closed
+		return 0, net.ErrClosed
+	}
+
+	return n, err
+}
+
+func (c *frozenConn) Write(b []byte) (int, error) {
+	if c.isFrozen() {
+		return len(b), nil
+	}
+
+	return c.Conn.Write(b)
+}
+
+func (c *frozenConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+func TestKeepalive(t *testing.T) {
+	s := &ssh.Server{
+		Addr: ":2222",
+		Handler: func(s ssh.Session) {
+			fmt.Fprintf(s, "%s", strings.Join(s.Command(), " "))
+		},
+		PasswordHandler: func(ctx ssh.Context, password string) bool {
+			return ctx.User() == "user" && password == "pass"
+		},
+	}
+	go s.ListenAndServe()
+
+	defer s.Close()
+
+	time.Sleep(3 * time.Second)
+
+	testCases := []struct {
+		name      string
+		reconnect []Option
+		output    interface{}
+	}{
+		{
+			"OKReconnect",
+			[]Option{WithReconnect(ReconnectPolicy{MaxAttempts: 3, Backoff: 100 * time.Millisecond})},
+			2,
+		},
+		{
+			"ErrConnectionLost",
+			nil,
+			"connection to localhost:2222 lost: err=no reply to 2 keepalive requests",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var conns []*frozenConn
+
+			dialer := DialerFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+				var d net.Dialer
+
+				conn, err := d.DialContext(ctx, network, address)
+				if err != nil {
+					return nil, err
+				}
+
+				fc := &frozenConn{Conn: conn, closed: make(chan struct{})}
+				conns = append(conns, fc)
+
+				return fc, nil
+			})
+
+			opts := append([]Option{
+				WithPort(2222),
+				WithUser("user"),
+				WithPassword("pass"),
+				WithHostKeyPolicy(InsecureIgnoreHostKey()),
+				WithDialer(dialer),
+				WithKeepalive(100*time.Millisecond, 2),
+			}, tc.reconnect...)
+
+			config, err := NewConfig("localhost", opts...)
+			require.Nil(t, err)
+
+			client, err := NewClient(config)
+			require.Nil(t, err)
+
+			cmd := "echo HelloWorld"
+			res, err := client.ExecCommand(cmd)
+			require.Nil(t, err)
+			require.Equal(t, cmd, string(res))
+
+			// Keepalives are left without reply
+			conns[0].freeze()
+
+			time.Sleep(time.Second)
+
+			res, err = client.ExecCommand(cmd)
+			if err != nil {
+				require.Equal(t, tc.output, err.Error())
+				return
+			}
+
+			require.Equal(t, cmd, string(res))
+			require.Equal(t, tc.output, len(conns))
+		})
+	}
+}
+
+func TestIsAliveWhileReconnecting(t *testing.T) {
+	s := &ssh.Server{
+		Addr: ":2222",
+		Handler: func(s ssh.Session) {
+			fmt.Fprintf(s, "%s", strings.Join(s.Command(), " "))
+		},
+		PasswordHandler: func(ctx ssh.Context, password string) bool {
+			return ctx.User() == "user" && password == "pass"
+		},
+	}
+	go s.ListenAndServe()
+
+	defer s.Close()
+
+	time.Sleep(3 * time.Second)
+
+	var conns []net.Conn
+
+	// Only the first connection succeeds
+	dialer := DialerFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		if len(conns) > 0 {
+			return nil, fmt.Errorf("network is unreachable")
+		}
+
+		var d net.Dialer
+
+		conn, err := d.DialContext(ctx, network, address)
+		if err == nil {
+			conns = append(conns, conn)
+		}
+
+		return conn, err
+	})
+
+	config, err := NewConfig("localhost",
+		WithPort(2222),
+		WithUser("user"),
+		WithPassword("pass"),
+		WithHostKeyPolicy(InsecureIgnoreHostKey()),
+		WithDialer(dialer),
+		WithReconnect(ReconnectPolicy{Backoff: time.Minute}),
+	)
+	require.Nil(t, err)
+
+	client, err := NewClient(config)
+	require.Nil(t, err)
+
+	conns[0].Close()
+
+	time.Sleep(100 * time.Millisecond)
+
+	// Reconnection waiting for its next attempt
+	errCh := make(chan error, 1)
+
+	go func() {
+		_, err := client.ExecCommand("echo HelloWorld")
+		errCh <- err
+	}()
+
+	time.Sleep(500 * time.Millisecond)
+
+	alive := make(chan bool, 1)
+
+	go func() {
+		alive <- client.IsAlive()
+	}()
+
+	select {
+	case ok := <-alive:
+		require.False(t, ok)
+	case <-time.After(time.Second):
+		require.Fail(t, "IsAlive blocked by the reconnection")
+	}
+
+	closed := make(chan struct{})
+
+	go func() {
+		client.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		require.Fail(t, "Close blocked by the reconnection")
+	}
+
+	require.Equal(t, ErrClientClosed, <-errCh)
+}
@@ -0,0 +1,171 @@
+package gossh
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// address returns the host:port address of the configuration
+func (c *Config) address() string {
+	return net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+}
+
+// hops returns the configurations of the hosts to connect to in
+// order to reach the host of the configuration: its jump hosts,
+// preceded by their own jump hosts, and itself.
+func (c *Config) hops() []*Config {
+	hops := []*Config{}
+
+	for _, jump := range c.JumpHosts {
+		hops = append(hops, jump.hops()...)
+	}
+
+	return append(hops, c)
+}
+
+// dial connects to the host of the configuration, through its jump
+// hosts if any: each hop is tunneled through the connection to the
+// previous one. It returns the client of the host and the ones of
+// the jump hosts.
+//
+// If conn is not nil, it is used as the connection to the first hop.
+// Otherwise, the first hop is reached with its dialer or, if nil,
+// the one of the configuration.
+//
+// The connection is aborted, and ctx.Err() returned, if ctx is done
+// before the last hop is reached.
+func dial(ctx context.Context, config *Config, conn net.Conn) (*ssh.Client, []*ssh.Client, error) {
+	var client *ssh.Client
+
+	hops := config.hops()
+	clients := []*ssh.Client{}
+
+	for i, hop := range hops {
+		var err error
+
+		if client == nil {
+			client, err = dialFirst(ctx, config, hop, conn)
+		} else {
+			client, err = dialThrough(ctx, client, hop)
+		}
+
+		if err != nil {
+			closeClients(clients)
+
+			if ctx.Err() != nil {
+				return nil, nil, ctx.Err()
+			}
+
+			if i < len(hops)-1 {
+				return nil, nil, fmt.Errorf("failed to connect to jump host %s: err=%s", hop.address(), err)
+			}
+
+			return nil, nil, err
+		}
+
+		clients = append(clients, client)
+	}
+
+	return client, clients[:len(clients)-1], nil
+}
+
+// dialFirst connects to the first hop with the given connection
+// or a new one
+func dialFirst(ctx context.Context, config, hop *Config, conn net.Conn) (*ssh.Client, error) {
+	if conn == nil {
+		var err error
+
+		conn, err = dialConn(ctx, config, hop)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return newClientConn(ctx, conn, hop)
+}
+
+// dialConn establishes the network connection to the first hop
+func dialConn(ctx context.Context, config, hop *Config) (net.Conn, error) {
+	dialer := hop.Dialer
+	if dialer == nil {
+		dialer = config.Dialer
+	}
+
+	if dialer == nil {
+		dialer = &net.Dialer{Timeout: hop.ClientConfig.Timeout}
+	} else if hop.ClientConfig.Timeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, hop.ClientConfig.Timeout)
+		defer cancel()
+	}
+
+	return dialer.DialContext(ctx, "tcp", hop.address())
+}
+
+// dialThrough connects to the host of the configuration through
+// the connection of the given client
+func dialThrough(ctx context.Context, client *ssh.Client, config *Config) (*ssh.Client, error) {
+	conn, err := client.DialContext(ctx, "tcp", config.address())
+	if err != nil {
+		return nil, err
+	}
+
+	return newClientConn(ctx, conn, config)
+}
+
+// newClientConn establishes the ssh connection over the given
+// network connection. The connection is closed if ctx is done
+// during the handshake.
+func newClientConn(ctx context.Context, conn net.Conn, config *Config) (*ssh.Client, error) {
+	stop := closeOnDone(ctx, conn)
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, config.address(), config.ClientConfig)
+
+	stop()
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if ctx.Err() != nil {
+		c.Close()
+		return nil, ctx.Err()
+	}
+
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// closeOnDone closes the connection if ctx is done before the
+// returned function is called
+func closeOnDone(ctx context.Context, conn net.Conn) func() {
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-stopped
+	}
+}
+
+// closeClients closes the given clients, the last one first
+func closeClients(clients []*ssh.Client) {
+	for i := len(clients) - 1; i >= 0; i-- {
+		clients[i].Close()
+	}
+}
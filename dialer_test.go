@@ -0,0 +1,191 @@
+package gossh
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/gliderlabs/ssh"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDialers(t *testing.T) {
+	var dialed []string
+
+	s := &ssh.Server{
+		Addr: ":2222",
+		Handler: func(s ssh.Session) {
+			fmt.Fprintf(s, "%s", strings.Join(s.Command(), " "))
+		},
+		PasswordHandler: func(ctx ssh.Context, password string) bool {
+			return ctx.User() == "user" && password == "pass"
+		},
+	}
+	go s.ListenAndServe()
+
+	defer s.Close()
+
+	// HTTP proxy only accepting CONNECT with credentials
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		if r.Header.Get("Proxy-Authorization") != "Basic cHJveHk6c2VjcmV0" {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+
+		dialed = append(dialed, r.Host)
+
+		remote, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer remote.Close()
+
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		fmt.Fprint(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+
+		go io.Copy(remote, buf)
+		io.Copy(conn, remote)
+	}))
+
+	defer proxy.Close()
+
+	time.Sleep(3 * time.Second)
+
+	testCases := []struct {
+		name   string
+		dialer func() (Dialer, error)
+		output interface{}
+	}{
+		{
+			"OKDialerFunc",
+			func() (Dialer, error) {
+				return DialerFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+					dialed = append(dialed, address)
+
+					var d net.Dialer
+					return d.DialContext(ctx, network, address)
+				}), nil
+			},
+			[]string{"localhost:2222"},
+		},
+		{
+			"OKHTTPConnect",
+			func() (Dialer, error) {
+				return HTTPConnectDialer("http://proxy:secret@" + proxy.Listener.Addr().String())
+			},
+			[]string{"localhost:2222"},
+		},
+		{
+			"ErrHTTPConnectAuth",
+			func() (Dialer, error) {
+				return HTTPConnectDialer("http://proxy:wrong@" + proxy.Listener.Addr().String())
+			},
+			"HTTP proxy refused to connect to localhost:2222: 407 Proxy Authentication Required",
+		},
+		{
+			"ErrHTTPConnectScheme",
+			func() (Dialer, error) {
+				return HTTPConnectDialer("ftp://" + proxy.Listener.Addr().String())
+			},
+			"unsupported HTTP proxy scheme: ftp",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dialed = nil
+
+			dialer, err := tc.dialer()
+			if err != nil {
+				require.Equal(t, tc.output, err.Error())
+				return
+			}
+
+			config, err := NewConfig("localhost", WithPort(2222), WithUser("user"), WithPassword("pass"), WithHostKeyPolicy(InsecureIgnoreHostKey()), WithDialer(dialer))
+			require.Nil(t, err)
+
+			client, err := NewClient(config)
+			if err != nil {
+				require.Equal(t, tc.output, err.Error())
+				return
+			}
+
+			require.Equal(t, tc.output, dialed)
+
+			cmd := "echo HelloWorld"
+			res, err := client.ExecCommand(cmd)
+			require.Nil(t, err)
+			require.Equal(t, cmd, string(res))
+		})
+	}
+}
+
+func TestNewClientFromConn(t *testing.T) {
+	data, err := ioutil.ReadFile("./data/id_rsa")
+	require.Nil(t, err)
+
+	hostKey, err := gossh.ParsePrivateKey(data)
+	require.Nil(t, err)
+
+	s := &ssh.Server{
+		HostSigners: []ssh.Signer{hostKey},
+		ChannelHandlers: map[string]ssh.ChannelHandler{
+			"session": ssh.DefaultSessionHandler,
+		},
+		Handler: func(s ssh.Session) {
+			fmt.Fprintf(s, "%s", strings.Join(s.Command(), " "))
+		},
+		PasswordHandler: func(ctx ssh.Context, password string) bool {
+			return ctx.User() == "user" && password == "pass"
+		},
+	}
+
+	// net.Pipe cannot be used: both sides send their version at once
+	// and its writes are synchronous
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			s.HandleConn(conn)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.Nil(t, err)
+
+	config, err := NewConfig("localhost", WithUser("user"), WithPassword("pass"), WithHostKeyPolicy(InsecureIgnoreHostKey()))
+	require.Nil(t, err)
+
+	client, err := NewClientFromConn(conn, config)
+	require.Nil(t, err)
+
+	cmd := "echo HelloWorld"
+	res, err := client.ExecCommand(cmd)
+	require.Nil(t, err)
+	require.Equal(t, cmd, string(res))
+}
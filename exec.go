@@ -0,0 +1,500 @@
+package gossh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Result is the outcome of a command executed on the remote machine
+type Result struct {
+	// Command is the command line which ran
+	Command string
+
+	Stdout []byte
+	Stderr []byte
+
+	// ExitCode is the exit status of the command, 128 + the signal
+	// number if it was killed by a signal as with shells
+	ExitCode int
+
+	// Signal is the name, without SIG prefix, of the signal which
+	// killed the command, empty otherwise
+	Signal string
+
+	// Duration is the time elapsed between the start of the command
+	// and its end
+	Duration time.Duration
+}
+
+// ExitError is returned by Exec when the command exits with
+// a non-zero status. Commands killed by a signal return
+// a *SignalError wrapping it.
+type ExitError struct {
+	Result *Result
+
+	// err is the error returned by the session
+	err *ssh.ExitError
+}
+
+// Error returns the command with its exit status or signal
+func (e *ExitError) Error() string {
+	if e.Result.Signal != "" {
+		return fmt.Sprintf("command %q killed by signal %s", e.Result.Command, e.Result.Signal)
+	}
+
+	return fmt.Sprintf("command %q exited with code %d", e.Result.Command, e.Result.ExitCode)
+}
+
+// Unwrap returns the underlying *ssh.ExitError
+func (e *ExitError) Unwrap() error {
+	return e.err
+}
+
+// SignalError is returned by Exec when the command is killed by a
+// signal. It wraps the *ExitError of the command so that both
+// types can be checked with errors.As.
+type SignalError struct {
+	*ExitError
+}
+
+// Error returns the command with the signal which killed it
+func (e *SignalError) Error() string {
+	return e.ExitError.Error()
+}
+
+// Unwrap returns the underlying *ExitError
+func (e *SignalError) Unwrap() error {
+	return e.ExitError
+}
+
+// ExecOption configures the execution of a command by Run or Start
+type ExecOption func(o *execOptions)
+
+// Cmd is a command running on the remote machine, started by Start
+type Cmd struct {
+	// Command is the command line which runs
+	Command string
+
+	session *ssh.Session
+	start   time.Time
+
+	// Output captured when not redirected to a writer
+	stdout *syncBuffer
+	stderr *syncBuffer
+
+	// done is closed when the command has ended
+	done   chan struct{}
+	result *Result
+	err    error
+}
+
+// WithStdin sets the reader whose content is sent to the standard
+// input of the command. The input is closed once it is all sent.
+func WithStdin(r io.Reader) ExecOption {
+	return func(o *execOptions) {
+		o.stdin = r
+	}
+}
+
+// WithStdout sets the writer receiving the standard output of the
+// command as it arrives, instead of capturing it in the result
+func WithStdout(w io.Writer) ExecOption {
+	return func(o *execOptions) {
+		o.stdout = w
+	}
+}
+
+// WithStderr sets the writer receiving the standard error of the
+// command as it arrives, instead of capturing it in the result
+func WithStderr(w io.Writer) ExecOption {
+	return func(o *execOptions) {
+		o.stderr = w
+	}
+}
+
+// WithEnv sets an environment variable of the command. It is sent
+// to the server, or exported by the command line if the server
+// rejects it (AcceptEnv of sshd) or with a privilege escalation,
+// which resets the environment.
+func WithEnv(name, value string) ExecOption {
+	return func(o *execOptions) {
+		o.env = append(o.env, envVar{name: name, value: value})
+	}
+}
+
+// WithDir sets the working directory of the command. The command
+// fails if the directory cannot be entered.
+func WithDir(dir string) ExecOption {
+	return func(o *execOptions) {
+		o.dir = dir
+	}
+}
+
+// Exec executes a command on the remote machine and returns its
+// result with stdout and stderr kept apart. If the command exits
+// with a non-zero status, the result is returned along with an
+// *ExitError.
+func (c *Client) Exec(cmd string) (*Result, error) {
+	return c.ExecContext(context.Background(), cmd)
+}
+
+// ExecContext is Exec aborting the command when ctx is done. The
+// result gathered so far is returned along with ctx.Err().
+func (c *Client) ExecContext(ctx context.Context, cmd string) (*Result, error) {
+	return c.RunContext(ctx, cmd)
+}
+
+// ExecArgs executes the program with the given arguments as Exec.
+// The name and the arguments are quoted: they are passed as is to
+// the program, whatever the characters they contain.
+func (c *Client) ExecArgs(name string, args ...string) (*Result, error) {
+	return c.ExecArgsContext(context.Background(), name, args...)
+}
+
+// ExecArgsContext is ExecArgs aborting the command when ctx is done
+func (c *Client) ExecArgsContext(ctx context.Context, name string, args ...string) (*Result, error) {
+	return c.RunContext(ctx, QuoteCommand(name, args...))
+}
+
+// Run executes a command on the remote machine with the given
+// options and waits for its end, as Start followed by Cmd.Wait.
+func (c *Client) Run(cmd string, opts ...ExecOption) (*Result, error) {
+	return c.RunContext(context.Background(), cmd, opts...)
+}
+
+// RunContext is Run aborting the command when ctx is done
+func (c *Client) RunContext(ctx context.Context, cmd string, opts ...ExecOption) (*Result, error) {
+	command, err := c.StartContext(ctx, cmd, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return command.Wait()
+}
+
+// Start starts a command on the remote machine without waiting for
+// its end. Its input and outputs are streamed from and to the
+// reader and writers given by the options.
+func (c *Client) Start(cmd string, opts ...ExecOption) (*Cmd, error) {
+	return c.StartContext(context.Background(), cmd, opts...)
+}
+
+// StartContext is Start aborting the command when ctx is done: the
+// remote process is sent SIGTERM, then SIGKILL if it is still
+// running a few seconds later, and the session is closed.
+func (c *Client) StartContext(ctx context.Context, cmd string, opts ...ExecOption) (*Cmd, error) {
+	o := &execOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	ctx, cancel := c.context(ctx)
+
+	session, err := c.newExecSession(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	command := &Cmd{
+		Command: cmd,
+		session: session,
+		done:    make(chan struct{}),
+	}
+
+	if o.become == nil {
+		o.become = c.become
+	}
+
+	copies, err := command.run(ctx, o)
+	if err != nil {
+		session.Close()
+		cancel()
+
+		return nil, err
+	}
+
+	go func() {
+		defer cancel()
+
+		command.wait(ctx, copies)
+	}()
+
+	return command, nil
+}
+
+// Wait waits for the command to end and returns its result. Output
+// redirected to writers is not part of the result. If the command
+// exits with a non-zero status, the result is returned along with
+// an *ExitError.
+func (cmd *Cmd) Wait() (*Result, error) {
+	<-cmd.done
+	return cmd.result, cmd.err
+}
+
+// Signal sends the signal to the remote process. The server may
+// not support signals: OpenSSH handles them from version 7.9.
+func (cmd *Cmd) Signal(sig ssh.Signal) error {
+	return cmd.session.Signal(sig)
+}
+
+// Kill sends SIGKILL to the remote process and closes the session.
+// Servers which do not handle signals hang up the process when the
+// session is closed.
+func (cmd *Cmd) Kill() error {
+	err := cmd.session.Signal(ssh.SIGKILL)
+
+	cmd.session.Close()
+
+	return err
+}
+
+///////// INTERNAL FUNCTIONS ////////////////////////////
+
+type execOptions struct {
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+	pty    *PTY
+	become *Become
+	env    []envVar
+	dir    string
+}
+
+type envVar struct {
+	name  string
+	value string
+}
+
+// run requests the pseudo-terminal, starts the command with the
+// privilege escalation if any, then connects its input and outputs
+func (cmd *Cmd) run(ctx context.Context, o *execOptions) (*sync.WaitGroup, error) {
+	var in io.WriteCloser
+	var err error
+
+	if o.pty != nil {
+		err = requestPTY(cmd.session, o.pty)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	command, err := cmd.prepare(o)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.become != nil {
+		command, err = o.become.command(command, o.pty != nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The password of the privilege escalation is sent on stdin
+	if o.stdin != nil || o.become != nil {
+		in, err = cmd.session.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	out, err := cmd.session.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	e, err := cmd.session.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd.start = time.Now()
+
+	err = cmd.session.Start(command)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.become != nil {
+		out, e, err = o.become.escalate(ctx, in, out, e)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return cmd.pipe(o, in, out, e), nil
+}
+
+// prepare sets the environment variables of the session and
+// returns the command line exporting those rejected by the server
+// and entering the working directory
+func (cmd *Cmd) prepare(o *execOptions) (string, error) {
+	prefix := ""
+
+	for _, v := range o.env {
+		if !isEnvName(v.name) {
+			return "", fmt.Errorf("invalid environment variable name: %q", v.name)
+		}
+
+		if o.become == nil && cmd.session.Setenv(v.name, v.value) == nil {
+			continue
+		}
+
+		prefix += "export " + v.name + "=" + shellQuote(v.value) + "; "
+	}
+
+	if o.dir != "" {
+		prefix += "cd " + shellQuote(o.dir) + " || exit; "
+	}
+
+	return prefix + cmd.Command, nil
+}
+
+// isEnvName returns true if the name is a valid name of shell
+// variable
+func isEnvName(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for i, r := range name {
+		switch {
+		case r == '_', r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+		case r >= '0' && r <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// pipe connects the input and the outputs of the session to the
+// reader and writers of the options, or to buffers for the outputs
+// without writer. The returned group waits for the outputs to be
+// copied.
+func (cmd *Cmd) pipe(o *execOptions, in io.WriteCloser, out, e io.Reader) *sync.WaitGroup {
+	copies := &sync.WaitGroup{}
+
+	if in != nil {
+		go func() {
+			defer in.Close()
+
+			if o.stdin != nil {
+				io.Copy(in, o.stdin)
+			}
+		}()
+	}
+
+	stdout := o.stdout
+	if stdout == nil {
+		cmd.stdout = &syncBuffer{}
+		stdout = cmd.stdout
+	}
+
+	stderr := o.stderr
+	if stderr == nil {
+		cmd.stderr = &syncBuffer{}
+		stderr = cmd.stderr
+	}
+
+	copies.Add(2)
+
+	go func() {
+		defer copies.Done()
+		io.Copy(stdout, out)
+	}()
+
+	go func() {
+		defer copies.Done()
+		io.Copy(stderr, e)
+	}()
+
+	return copies
+}
+
+// wait waits for the end of the command, or aborts it when ctx is
+// done, then records its result
+func (cmd *Cmd) wait(ctx context.Context, copies *sync.WaitGroup) {
+	defer close(cmd.done)
+	defer cmd.session.Close()
+
+	done := make(chan error, 1)
+
+	go func() {
+		copies.Wait()
+		done <- cmd.session.Wait()
+	}()
+
+	var err error
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		abortSession(cmd.session, done)
+		err = context.Cause(ctx)
+	}
+
+	res := &Result{
+		Command:  cmd.Command,
+		Duration: time.Since(cmd.start),
+	}
+
+	if cmd.stdout != nil {
+		res.Stdout = cmd.stdout.Bytes()
+	}
+
+	if cmd.stderr != nil {
+		res.Stderr = cmd.stderr.Bytes()
+	}
+
+	cmd.result = res
+	cmd.err = newExitError(res, err)
+}
+
+// newExecSession opens a new session to execute a command, with
+// the agent forwarding if enabled
+func (c *Client) newExecSession(ctx context.Context) (*ssh.Session, error) {
+	session, err := c.newSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.config.forwardAgent {
+		err = agent.RequestAgentForwarding(session)
+		if err != nil {
+			session.Close()
+			return nil, err
+		}
+	}
+
+	return session, nil
+}
+
+// newExitError fills the exit status of the result from the error
+// returned by the session and converts it into an *ExitError, or a
+// *SignalError if the command was killed by a signal
+func newExitError(res *Result, err error) error {
+	var exitErr *ssh.ExitError
+
+	if !errors.As(err, &exitErr) {
+		return err
+	}
+
+	res.ExitCode = exitErr.ExitStatus()
+	res.Signal = exitErr.Signal()
+
+	if res.Signal != "" {
+		return &SignalError{&ExitError{Result: res, err: exitErr}}
+	}
+
+	return &ExitError{Result: res, err: exitErr}
+}
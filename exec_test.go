@@ -0,0 +1,421 @@
+package gossh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/gliderlabs/ssh"
+
+	"github.com/stretchr/testify/require"
+)
+
+// execHandler writes its command to stdout and stderr, then exits
+// with the code given by "exit <code>" or is killed by the signal
+// given by "kill <signal>"
+func execHandler(s ssh.Session) {
+	args := s.Command()
+
+	s.Write([]byte("stdout: " + strings.Join(args, " ")))
+	s.Stderr().Write([]byte("stderr: " + strings.Join(args, " ")))
+
+	switch args[0] {
+	case "exit":
+		code, _ := strconv.Atoi(args[1])
+		s.Exit(code)
+	case "kill":
+		exitSignal(s, args[1])
+	default:
+		s.Exit(0)
+	}
+}
+
+// exitSignal reports the command killed by the signal and closes the
+// session
+func exitSignal(s ssh.Session, sig string) {
+	msg := struct {
+		Signal     string
+		CoreDumped bool
+		Error      string
+		Lang       string
+	}{Signal: sig}
+
+	s.SendRequest("exit-signal", false, gossh.Marshal(&msg))
+	s.Close()
+}
+
+func TestExec(t *testing.T) {
+	s := &ssh.Server{
+		Addr:    ":2222",
+		Handler: execHandler,
+		PasswordHandler: func(ctx ssh.Context, password string) bool {
+			return ctx.User() == "user" && password == "pass"
+		},
+	}
+	go s.ListenAndServe()
+
+	defer s.Close()
+
+	time.Sleep(3 * time.Second)
+
+	testCases := []struct {
+		name     string
+		cmd      string
+		exitCode int
+		signal   string
+		output   interface{}
+	}{
+		{
+			"OK",
+			"echo HelloWorld",
+			0,
+			"",
+			nil,
+		},
+		{
+			"ErrExitCode",
+			"exit 3",
+			3,
+			"",
+			"command \"exit 3\" exited with code 3",
+		},
+		{
+			"ErrSignal",
+			"kill KILL",
+			137,
+			"KILL",
+			"command \"kill KILL\" killed by signal KILL",
+		},
+	}
+
+	config, err := NewClientConfigWithUserPass("user", "pass", "localhost", 2222, false)
+	require.Nil(t, err)
+
+	client, err := NewClient(config)
+	require.Nil(t, err)
+
+	defer client.Close()
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := client.Exec(tc.cmd)
+			if err != nil {
+				require.Equal(t, tc.output, err.Error())
+
+				var exitErr *ExitError
+				require.True(t, errors.As(err, &exitErr))
+				require.Equal(t, res, exitErr.Result)
+
+				var signalErr *SignalError
+				require.Equal(t, tc.signal != "", errors.As(err, &signalErr))
+			} else {
+				require.Nil(t, tc.output)
+			}
+
+			require.Equal(t, tc.cmd, res.Command)
+			require.Equal(t, "stdout: "+tc.cmd, string(res.Stdout))
+			require.Equal(t, "stderr: "+tc.cmd, string(res.Stderr))
+			require.Equal(t, tc.exitCode, res.ExitCode)
+			require.Equal(t, tc.signal, res.Signal)
+			require.True(t, res.Duration > 0)
+		})
+	}
+}
+
+func TestRun(t *testing.T) {
+	signals := make(chan ssh.Signal, 1)
+
+	s := &ssh.Server{
+		Addr: ":2222",
+		Handler: func(s ssh.Session) {
+			switch s.Command()[0] {
+			case "cat":
+				io.Copy(s, s)
+				s.Exit(0)
+			case "sleep":
+				sigs := make(chan ssh.Signal, 1)
+				s.Signals(sigs)
+
+				signals <- <-sigs
+			default:
+				execHandler(s)
+			}
+		},
+		PasswordHandler: func(ctx ssh.Context, password string) bool {
+			return ctx.User() == "user" && password == "pass"
+		},
+	}
+	go s.ListenAndServe()
+
+	defer s.Close()
+
+	time.Sleep(3 * time.Second)
+
+	config, err := NewClientConfigWithUserPass("user", "pass", "localhost", 2222, false)
+	require.Nil(t, err)
+
+	client, err := NewClient(config)
+	require.Nil(t, err)
+
+	defer client.Close()
+
+	// Input and outputs streamed
+	var stdout, stderr bytes.Buffer
+
+	res, err := client.Run("cat", WithStdin(strings.NewReader("HelloWorld")), WithStdout(&stdout), WithStderr(&stderr))
+	require.Nil(t, err)
+	require.Equal(t, "HelloWorld", stdout.String())
+	require.Empty(t, stderr.String())
+	require.Nil(t, res.Stdout)
+	require.Nil(t, res.Stderr)
+
+	// Only stdout streamed, stderr captured
+	stdout.Reset()
+
+	res, err = client.Run("exit 2", WithStdout(&stdout))
+	require.Equal(t, "command \"exit 2\" exited with code 2", err.Error())
+	require.Equal(t, "stdout: exit 2", stdout.String())
+	require.Nil(t, res.Stdout)
+	require.Equal(t, "stderr: exit 2", string(res.Stderr))
+	require.Equal(t, 2, res.ExitCode)
+
+	// Killed command
+	cmd, err := client.Start("sleep 60")
+	require.Nil(t, err)
+
+	err = cmd.Kill()
+	require.Nil(t, err)
+	require.Equal(t, ssh.SIGKILL, <-signals)
+
+	_, err = cmd.Wait()
+	require.NotNil(t, err)
+}
+
+func TestSignal(t *testing.T) {
+	signals := make(chan ssh.Signal, 4)
+
+	s := &ssh.Server{
+		Addr: ":2222",
+		Handler: func(s ssh.Session) {
+			sigs := make(chan ssh.Signal, 2)
+			s.Signals(sigs)
+
+			// Only sleep exits on SIGTERM
+			for sig := range sigs {
+				signals <- sig
+
+				if sig != ssh.SIGTERM || s.Command()[0] == "sleep" {
+					exitSignal(s, string(sig))
+					return
+				}
+			}
+		},
+		PasswordHandler: func(ctx ssh.Context, password string) bool {
+			return ctx.User() == "user" && password == "pass"
+		},
+	}
+	go s.ListenAndServe()
+
+	defer s.Close()
+
+	time.Sleep(3 * time.Second)
+
+	config, err := NewClientConfigWithUserPass("user", "pass", "localhost", 2222, false)
+	require.Nil(t, err)
+
+	client, err := NewClient(config)
+	require.Nil(t, err)
+
+	defer client.Close()
+
+	// Signal sent to a running command
+	cmd, err := client.Start("sleep 60")
+	require.Nil(t, err)
+
+	err = cmd.Signal(gossh.SIGINT)
+	require.Nil(t, err)
+	require.Equal(t, ssh.SIGINT, <-signals)
+
+	res, err := cmd.Wait()
+	require.Equal(t, "command \"sleep 60\" killed by signal INT", err.Error())
+	require.Equal(t, 130, res.ExitCode)
+	require.Equal(t, "INT", res.Signal)
+
+	var signalErr *SignalError
+	require.True(t, errors.As(err, &signalErr))
+	require.Equal(t, res, signalErr.Result)
+
+	// SIGTERM on timeout, exited
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	_, err = client.RunContext(ctx, "sleep 60")
+	require.Equal(t, context.DeadlineExceeded, err)
+	require.Equal(t, ssh.SIGTERM, <-signals)
+
+	// SIGTERM ignored, then SIGKILL
+	gracePeriod := abortGracePeriod
+	abortGracePeriod = 500 * time.Millisecond
+
+	defer func() {
+		abortGracePeriod = gracePeriod
+	}()
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+
+	_, err = client.RunContext(ctx, "trap '' TERM; sleep 60")
+	require.Equal(t, context.DeadlineExceeded, err)
+	require.Equal(t, ssh.SIGTERM, <-signals)
+	require.Equal(t, ssh.SIGKILL, <-signals)
+	require.True(t, time.Since(start) >= 600*time.Millisecond)
+
+	// Same for the transfers
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	err = client.SCPSendBytesContext(ctx, []byte("HelloWorld"), "/tmp/file", "0644")
+	require.Equal(t, context.DeadlineExceeded, err)
+	require.Equal(t, ssh.SIGTERM, <-signals)
+	require.Equal(t, ssh.SIGKILL, <-signals)
+}
+
+func TestEnvAndDir(t *testing.T) {
+	bin, err := ioutil.TempDir("", "gossh")
+	require.Nil(t, err)
+
+	defer os.RemoveAll(bin)
+
+	err = ioutil.WriteFile(filepath.Join(bin, "sudo"), []byte(fakeSudo), 0755)
+	require.Nil(t, err)
+
+	wd, err := os.Getwd()
+	require.Nil(t, err)
+
+	dir := filepath.Join(bin, "my 'dir'")
+
+	err = os.Mkdir(dir, 0755)
+	require.Nil(t, err)
+
+	s := &ssh.Server{
+		Addr:    ":2222",
+		Handler: shellHandler(bin),
+		PasswordHandler: func(ctx ssh.Context, password string) bool {
+			return ctx.User() == "user" && password == "pass"
+		},
+	}
+	go s.ListenAndServe()
+
+	defer s.Close()
+
+	time.Sleep(3 * time.Second)
+
+	testCases := []struct {
+		name   string
+		opts   []ExecOption
+		output interface{}
+	}{
+		{
+			"OKEnv",
+			[]ExecOption{WithEnv("GOSSH_A", "1"), WithEnv("GOSSH_B", "$HOME 'quoted'")},
+			"1:$HOME 'quoted':" + wd + "\n",
+		},
+		{
+			"OKEnvBecome",
+			[]ExecOption{WithEnv("GOSSH_A", "1"), WithEnv("GOSSH_B", "a;b"), WithBecome(Become{Password: "secret"})},
+			"1:a;b:" + wd + "\n",
+		},
+		{
+			"OKDir",
+			[]ExecOption{WithDir(dir), WithEnv("GOSSH_A", "2")},
+			"2::" + dir + "\n",
+		},
+		{
+			"ErrDir",
+			[]ExecOption{WithDir(filepath.Join(bin, "missing"))},
+			"command \"echo $GOSSH_A:$GOSSH_B:$(pwd)\" exited with code 2",
+		},
+		{
+			"ErrEnvName",
+			[]ExecOption{WithEnv("GOSSH-A", "1")},
+			"invalid environment variable name: \"GOSSH-A\"",
+		},
+	}
+
+	config, err := NewClientConfigWithUserPass("user", "pass", "localhost", 2222, false)
+	require.Nil(t, err)
+
+	client, err := NewClient(config)
+	require.Nil(t, err)
+
+	defer client.Close()
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := client.Run("echo $GOSSH_A:$GOSSH_B:$(pwd)", tc.opts...)
+			if err != nil {
+				require.Equal(t, tc.output, err.Error())
+				return
+			}
+
+			require.Equal(t, tc.output, string(res.Stdout))
+		})
+	}
+}
+
+func TestExecArgs(t *testing.T) {
+	s := &ssh.Server{
+		Addr:    ":2222",
+		Handler: shellHandler(""),
+		PasswordHandler: func(ctx ssh.Context, password string) bool {
+			return ctx.User() == "user" && password == "pass"
+		},
+	}
+	go s.ListenAndServe()
+
+	defer s.Close()
+
+	time.Sleep(3 * time.Second)
+
+	config, err := NewClientConfigWithUserPass("user", "pass", "localhost", 2222, false)
+	require.Nil(t, err)
+
+	client, err := NewClient(config)
+	require.Nil(t, err)
+
+	defer client.Close()
+
+	res, err := client.ExecArgs("printf", "%s|", "a b", "$(id)", "it's; echo injected")
+	require.Nil(t, err)
+	require.Equal(t, "a b|$(id)|it's; echo injected|", string(res.Stdout))
+
+	// SCP paths are quoted the same way
+	dir, err := ioutil.TempDir("", "gossh")
+	require.Nil(t, err)
+
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "it's a file; touch injected")
+
+	err = client.SCPSendBytes([]byte("HelloWorld"), file, "0644")
+	require.Nil(t, err)
+
+	content, err := ioutil.ReadFile(file)
+	require.Nil(t, err)
+	require.Equal(t, "HelloWorld", string(content))
+
+	_, err = os.Stat("injected")
+	require.True(t, os.IsNotExist(err))
+}
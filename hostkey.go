@@ -0,0 +1,145 @@
+package gossh
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// HostKeyPolicy defines how the key presented by the remote
+// machine is verified during the handshake.
+type HostKeyPolicy interface {
+	// HostKeyCallback returns the callback verifying the keys
+	// presented by host:port and the host key algorithms to
+	// negotiate with it. Nil algorithms mean the default ones.
+	HostKeyCallback(host string, port int) (ssh.HostKeyCallback, []string, error)
+}
+
+// HostKeyPolicyFunc is an adapter to use a function as HostKeyPolicy
+type HostKeyPolicyFunc func(host string, port int) (ssh.HostKeyCallback, []string, error)
+
+// HostKeyCallback calls f(host, port)
+func (f HostKeyPolicyFunc) HostKeyCallback(host string, port int) (ssh.HostKeyCallback, []string, error) {
+	return f(host, port)
+}
+
+// InsecureIgnoreHostKey returns a policy accepting any host key.
+// It should not be used for production code.
+func InsecureIgnoreHostKey() HostKeyPolicy {
+	return HostKeyPolicyFunc(func(host string, port int) (ssh.HostKeyCallback, []string, error) {
+		return ssh.InsecureIgnoreHostKey(), nil, nil
+	})
+}
+
+// KnownHosts returns a policy verifying host keys against the given
+// known_hosts files, $HOME/.ssh/known_hosts by default.
+// Unknown hosts are rejected.
+func KnownHosts(files ...string) HostKeyPolicy {
+	return HostKeyPolicyFunc(func(host string, port int) (ssh.HostKeyCallback, []string, error) {
+		return newKnownHostsConfig(host, port, files...)
+	})
+}
+
+// TrustOnFirstUse returns a policy accepting the key of an unknown
+// host and appending it to the given known_hosts file,
+// $HOME/.ssh/known_hosts if empty. If hashed is true, the hostname
+// is recorded in its hashed form (|1|...).
+//
+// Once recorded, the key is verified as with KnownHosts: the
+// connection fails if the host presents another key.
+func TrustOnFirstUse(file string, hashed bool) HostKeyPolicy {
+	return HostKeyPolicyFunc(func(host string, port int) (ssh.HostKeyCallback, []string, error) {
+		knownHostsFile := file
+		if knownHostsFile == "" {
+			knownHostsFile = DefaultKnownHostsFile()
+		}
+
+		return newTOFUConfig(host, port, knownHostsFile, hashed)
+	})
+}
+
+// HostCertificates is a policy verifying host certificates signed
+// by trusted certificate authorities, as with @cert-authority lines
+// in known_hosts files.
+//
+// The certificate must be a host certificate signed by one of the
+// authorities, valid at the current time, having the hostname among
+// its principals and not be revoked.
+type HostCertificates struct {
+	// Authorities are the public keys of the trusted CAs
+	Authorities []ssh.PublicKey
+
+	// IsRevoked, if not nil, returns true for revoked certificates
+	IsRevoked func(cert *ssh.Certificate) bool
+
+	// Fallback, if not nil, is the policy verifying host keys which
+	// are not certificates. They are rejected otherwise.
+	Fallback HostKeyPolicy
+
+	// Clock, if not nil, returns the time used to check the validity
+	// of certificates. time.Now is used otherwise.
+	Clock func() time.Time
+}
+
+// CertAuthority returns a HostCertificates policy trusting the CA
+// public keys contained in the given files in authorized_keys
+// format, for example ca.pub.
+func CertAuthority(caFiles ...string) (*HostCertificates, error) {
+	p := &HostCertificates{}
+
+	for _, caFile := range caFiles {
+		content, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		for len(bytes.TrimSpace(content)) > 0 {
+			var caKey ssh.PublicKey
+
+			caKey, _, _, content, err = ssh.ParseAuthorizedKey(content)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse CA public key %s: err=%s", caFile, err)
+			}
+
+			p.Authorities = append(p.Authorities, caKey)
+		}
+	}
+
+	return p, nil
+}
+
+// HostKeyCallback returns the callback checking host certificates
+// with ssh.CertChecker.
+func (p *HostCertificates) HostKeyCallback(host string, port int) (ssh.HostKeyCallback, []string, error) {
+	checker := &ssh.CertChecker{
+		IsHostAuthority: func(auth ssh.PublicKey, address string) bool {
+			for _, caKey := range p.Authorities {
+				if bytes.Equal(caKey.Marshal(), auth.Marshal()) {
+					return true
+				}
+			}
+
+			return false
+		},
+		IsRevoked: func(cert *ssh.Certificate) bool {
+			return p.IsRevoked != nil && p.IsRevoked(cert)
+		},
+		Clock: p.Clock,
+	}
+
+	if p.Fallback != nil {
+		fallback, _, err := p.Fallback.HostKeyCallback(host, port)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		checker.HostKeyFallback = fallback
+	}
+
+	// Default host key algorithms are kept: they give preference to
+	// certificates.
+	return checker.CheckHostKey, nil, nil
+}
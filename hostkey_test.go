@@ -0,0 +1,139 @@
+package gossh
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/gliderlabs/ssh"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHostCertificates(t *testing.T) {
+	data, err := ioutil.ReadFile("./data/id_rsa")
+	require.Nil(t, err)
+
+	hostKey, err := gossh.ParsePrivateKey(data)
+	require.Nil(t, err)
+
+	data, err = ioutil.ReadFile("./data/ca")
+	require.Nil(t, err)
+
+	ca, err := gossh.ParsePrivateKey(data)
+	require.Nil(t, err)
+
+	// Host certificate valid for one hour for localhost
+	cert := &gossh.Certificate{
+		Key:             hostKey.PublicKey(),
+		Serial:          1,
+		CertType:        gossh.HostCert,
+		KeyId:           "localhost",
+		ValidPrincipals: []string{"localhost"},
+		ValidAfter:      uint64(time.Now().Add(-time.Minute).Unix()),
+		ValidBefore:     uint64(time.Now().Add(time.Hour).Unix()),
+	}
+
+	err = cert.SignCert(rand.Reader, ca)
+	require.Nil(t, err)
+
+	certSigner, err := gossh.NewCertSigner(cert, hostKey)
+	require.Nil(t, err)
+
+	testCases := []struct {
+		name   string
+		host   string
+		policy func(p *HostCertificates)
+		output interface{}
+	}{
+		{
+			"OK",
+			"localhost",
+			func(p *HostCertificates) {},
+			nil,
+		},
+		{
+			"ErrPrincipal",
+			"127.0.0.1",
+			func(p *HostCertificates) {},
+			"ssh: handshake failed: ssh: principal \"127.0.0.1\" not in the set of valid principals for given certificate: [\"localhost\"]",
+		},
+		{
+			"ErrExpired",
+			"localhost",
+			func(p *HostCertificates) {
+				p.Clock = func() time.Time {
+					return time.Now().Add(2 * time.Hour)
+				}
+			},
+			"ssh: handshake failed: ssh: cert has expired",
+		},
+		{
+			"ErrRevoked",
+			"localhost",
+			func(p *HostCertificates) {
+				p.IsRevoked = func(cert *gossh.Certificate) bool {
+					return cert.Serial == 1
+				}
+			},
+			"ssh: handshake failed: ssh: certificate serial 1 revoked",
+		},
+		{
+			"ErrUnknownAuthority",
+			"localhost",
+			func(p *HostCertificates) {
+				p.Authorities = []gossh.PublicKey{hostKey.PublicKey()}
+			},
+			"ssh: handshake failed: ssh: no authorities for hostname: localhost:2222",
+		},
+	}
+
+	s := &ssh.Server{
+		Addr: ":2222",
+		Handler: func(s ssh.Session) {
+			fmt.Fprintf(s, "%s", strings.Join(s.Command(), " "))
+		},
+		HostSigners: []ssh.Signer{certSigner},
+		PasswordHandler: func(ctx ssh.Context, password string) bool {
+			return ctx.User() == "user" && password == "pass"
+		},
+	}
+	go s.ListenAndServe()
+
+	defer s.Close()
+
+	time.Sleep(3 * time.Second)
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config, err := NewClientConfigWithUserPass("user", "pass", tc.host, 2222, false)
+			require.Nil(t, err)
+
+			policy, err := CertAuthority("./data/ca.pub")
+			require.Nil(t, err)
+
+			tc.policy(policy)
+
+			err = config.SetHostKeyPolicy(policy)
+			require.Nil(t, err)
+
+			client, err := NewClient(config)
+			if err != nil {
+				require.Equal(t, tc.output, err.Error())
+				return
+			}
+
+			require.Nil(t, tc.output)
+
+			cmd := "echo HelloWorld"
+			res, err := client.ExecCommand(cmd)
+			require.Nil(t, err)
+			require.Equal(t, cmd, string(res))
+		})
+	}
+}
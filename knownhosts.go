@@ -0,0 +1,278 @@
+package gossh
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// hostCertAlgorithms are the algorithms of the host certificates,
+// negotiated when a @cert-authority line matches the host
+var hostCertAlgorithms = []string{
+	ssh.CertAlgoED25519v01,
+	ssh.CertAlgoECDSA256v01,
+	ssh.CertAlgoECDSA384v01,
+	ssh.CertAlgoECDSA521v01,
+	ssh.CertAlgoRSASHA512v01,
+	ssh.CertAlgoRSASHA256v01,
+	ssh.CertAlgoRSAv01,
+}
+
+// tofuMutex serializes the checks and the writes of known_hosts
+// files by the trust-on-first-use policy
+var tofuMutex sync.Mutex
+
+// DefaultKnownHostsFile returns the path to the user's
+// known_hosts file: $HOME/.ssh/known_hosts
+func DefaultKnownHostsFile() string {
+	return filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts")
+}
+
+// KnownHostsCallback returns a host key callback checking the key
+// presented by the remote machine during the handshake against
+// the given known_hosts files. If no file is given,
+// $HOME/.ssh/known_hosts is used.
+//
+// It follows OpenSSH semantics: hashed hostnames (|1|...), host
+// patterns with wildcards and negations, [host]:port entries,
+// several key types per host, @cert-authority and @revoked markers.
+func KnownHostsCallback(files ...string) (ssh.HostKeyCallback, error) {
+	if len(files) == 0 {
+		files = []string{DefaultKnownHostsFile()}
+	}
+
+	return knownhosts.New(files...)
+}
+
+///////// INTERNAL FUNCTIONS ////////////////////////////
+
+// newKnownHostsConfig returns the host key callback checking
+// host:port against the given known_hosts files and the host key
+// algorithms corresponding to the keys already known for it.
+//
+// Restricting the algorithms makes the server present a key of a
+// type we know instead of failing the verification because it
+// prefers another type. If a @cert-authority line matches the host,
+// its certificates are preferred, as by OpenSSH.
+func newKnownHostsConfig(host string, port int, files ...string) (ssh.HostKeyCallback, []string, error) {
+	if len(files) == 0 {
+		files = []string{DefaultKnownHostsFile()}
+	}
+
+	callback, err := KnownHostsCallback(files...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	algos := knownHostKeyAlgorithms(callback, host, port, files...)
+
+	return callback, algos, nil
+}
+
+// newTOFUConfig returns the host key callback recording the key of
+// unknown hosts in the given known_hosts file and verifying the
+// others against it, along with the host key algorithms of the keys
+// already known for host:port.
+func newTOFUConfig(host string, port int, file string, hashed bool) (ssh.HostKeyCallback, []string, error) {
+	err := createKnownHostsFile(file)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	_, algos, err := newKnownHostsConfig(host, port, file)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tofu := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		var keyErr *knownhosts.KeyError
+
+		tofuMutex.Lock()
+		defer tofuMutex.Unlock()
+
+		// Reload the file each time: the key may have been recorded
+		// by a previous connection using the same configuration.
+		callback, err := KnownHostsCallback(file)
+		if err != nil {
+			return err
+		}
+
+		err = callback(hostname, remote, key)
+		if !errors.As(err, &keyErr) || len(keyErr.Want) > 0 {
+			// Known key, revoked key or key mismatch
+			return err
+		}
+
+		return appendKnownHost(file, hostname, key, hashed)
+	}
+
+	return tofu, algos, nil
+}
+
+// knownHostKeyAlgorithms returns the types of the keys known for
+// host:port by the given callback, loaded from the known_hosts files,
+// preceded by the certificate algorithms if an authority of the host
+// is known. It returns nil if the host is unknown.
+func knownHostKeyAlgorithms(callback ssh.HostKeyCallback, host string, port int, files ...string) []string {
+	var keyErr *knownhosts.KeyError
+
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+	remote := &net.TCPAddr{IP: net.IPv4zero, Port: port}
+
+	// knownhosts does not expose its database. Checking a key which
+	// cannot be known returns the error listing all the known ones.
+	err := callback(address, remote, probeKey{})
+	if !errors.As(err, &keyErr) {
+		return nil
+	}
+
+	authorities := knownHostAuthorities(callback, host, port, files...)
+
+	algos := []string{}
+
+	if len(authorities) > 0 {
+		algos = append(algos, hostCertAlgorithms...)
+	}
+
+	for _, known := range keyErr.Want {
+		// The keys of the authorities are listed too
+		if containsKey(authorities, known.Key) {
+			continue
+		}
+
+		// RSA keys are also used with SHA-2 signatures
+		if known.Key.Type() == ssh.KeyAlgoRSA {
+			algos = append(algos, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256)
+		}
+
+		algos = append(algos, known.Key.Type())
+	}
+
+	if len(algos) == 0 {
+		return nil
+	}
+
+	return algos
+}
+
+// knownHostAuthorities returns the keys of the @cert-authority lines
+// of the known_hosts files matching host:port for the given callback
+func knownHostAuthorities(callback ssh.HostKeyCallback, host string, port int, files ...string) []ssh.PublicKey {
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+	remote := &net.TCPAddr{IP: net.IPv4zero, Port: port}
+
+	authorities := []ssh.PublicKey{}
+
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+
+		for {
+			var marker string
+			var key ssh.PublicKey
+
+			marker, _, key, _, data, err = ssh.ParseKnownHosts(data)
+			if err != nil {
+				break
+			}
+
+			if marker != "cert-authority" {
+				continue
+			}
+
+			// knownhosts does not expose its authorities either. A
+			// certificate signed by one which does not match the
+			// host fails before its signature is checked.
+			cert := &ssh.Certificate{
+				Key:          key,
+				CertType:     ssh.HostCert,
+				SignatureKey: key,
+			}
+
+			err = callback(address, remote, cert)
+			if err != nil && !strings.Contains(err.Error(), "no authorities for hostname") {
+				authorities = append(authorities, key)
+			}
+		}
+	}
+
+	return authorities
+}
+
+// containsKey returns true if the key is one of the given keys
+func containsKey(keys []ssh.PublicKey, key ssh.PublicKey) bool {
+	for _, k := range keys {
+		if bytes.Equal(k.Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// createKnownHostsFile creates the known_hosts file and its parent
+// directory if they do not exist
+func createKnownHostsFile(file string) error {
+	err := os.MkdirAll(filepath.Dir(file), 0700)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_RDONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// appendKnownHost appends a new line for the hostname, normalized
+// as [host]:port for non-standard ports, with its key to the given
+// known_hosts file
+func appendKnownHost(file, hostname string, key ssh.PublicKey, hashed bool) error {
+	address := knownhosts.Normalize(hostname)
+	if hashed {
+		address = knownhosts.HashHostname(address)
+	}
+
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintln(f, knownhosts.Line([]string{address}, key))
+	if err != nil {
+		return fmt.Errorf("failed to record host key: err=%s", err)
+	}
+
+	return f.Sync()
+}
+
+// probeKey is a fake public key only used to list the keys known
+// for a host.
+type probeKey struct{}
+
+func (probeKey) Type() string {
+	return "gossh-probe"
+}
+
+func (probeKey) Marshal() []byte {
+	return []byte("gossh-probe")
+}
+
+func (probeKey) Verify(data []byte, sig *ssh.Signature) error {
+	return errors.New("gossh: probe key cannot verify signatures")
+}
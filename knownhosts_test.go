@@ -0,0 +1,323 @@
+package gossh
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/gliderlabs/ssh"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKnownHosts(t *testing.T) {
+	data, err := ioutil.ReadFile("./data/id_rsa")
+	require.Nil(t, err)
+
+	hostKey, err := gossh.ParsePrivateKey(data)
+	require.Nil(t, err)
+
+	data, err = ioutil.ReadFile("./data/ca.pub")
+	require.Nil(t, err)
+
+	otherKey, _, _, _, err := gossh.ParseAuthorizedKey(data)
+	require.Nil(t, err)
+
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+
+	edKey, err := gossh.NewPublicKey(pub)
+	require.Nil(t, err)
+
+	testCases := []struct {
+		name       string
+		knownHosts string
+		output     interface{}
+	}{
+		{
+			"OKHashedHost",
+			knownhosts.Line([]string{knownhosts.HashHostname("[localhost]:2222")}, hostKey.PublicKey()),
+			nil,
+		},
+		{
+			"OKPatternAndSeveralKeys",
+			knownhosts.Line([]string{"[localhost]:2222"}, edKey) + "\n" +
+				strings.Replace(knownhosts.Line([]string{"[localhost]:2222"}, hostKey.PublicKey()), "[localhost]:2222", "[*host]:2222,!127.0.0.1", 1),
+			nil,
+		},
+		{
+			"ErrUnknownHost",
+			knownhosts.Line([]string{"[otherhost]:2222"}, hostKey.PublicKey()),
+			"ssh: handshake failed: knownhosts: key is unknown",
+		},
+		{
+			"ErrKeyMismatch",
+			knownhosts.Line([]string{"[localhost]:2222"}, otherKey),
+			"ssh: handshake failed: knownhosts: key mismatch",
+		},
+		{
+			"ErrRevoked",
+			knownhosts.Line([]string{"[localhost]:2222"}, hostKey.PublicKey()) + "\n" +
+				"@revoked * " + strings.TrimSpace(string(gossh.MarshalAuthorizedKey(hostKey.PublicKey()))),
+			"ssh: handshake failed: knownhosts: key is revoked",
+		},
+	}
+
+	s := &ssh.Server{
+		Addr: ":2222",
+		Handler: func(s ssh.Session) {
+			fmt.Fprintf(s, "%s", strings.Join(s.Command(), " "))
+		},
+		HostSigners: []ssh.Signer{hostKey},
+		PasswordHandler: func(ctx ssh.Context, password string) bool {
+			return ctx.User() == "user" && password == "pass"
+		},
+	}
+	go s.ListenAndServe()
+
+	defer s.Close()
+
+	time.Sleep(3 * time.Second)
+
+	home, err := ioutil.TempDir("", "gossh")
+	require.Nil(t, err)
+
+	defer os.RemoveAll(home)
+
+	err = os.Mkdir(filepath.Join(home, ".ssh"), 0700)
+	require.Nil(t, err)
+
+	oldHome := os.Getenv("HOME")
+	os.Setenv("HOME", home)
+
+	defer os.Setenv("HOME", oldHome)
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ioutil.WriteFile(DefaultKnownHostsFile(), []byte(tc.knownHosts+"\n"), 0600)
+			require.Nil(t, err)
+
+			config, err := NewClientConfigWithUserPass("user", "pass", "localhost", 2222, true)
+			require.Nil(t, err)
+
+			client, err := NewClient(config)
+			if err != nil {
+				require.Equal(t, tc.output, err.Error())
+				return
+			}
+
+			require.Nil(t, tc.output)
+
+			cmd := "echo HelloWorld"
+			res, err := client.ExecCommand(cmd)
+			require.Nil(t, err)
+			require.Equal(t, cmd, string(res))
+		})
+	}
+}
+
+func TestKnownHostKeyAlgorithms(t *testing.T) {
+	data, err := ioutil.ReadFile("./data/id_rsa")
+	require.Nil(t, err)
+
+	hostKey, err := gossh.ParsePrivateKey(data)
+	require.Nil(t, err)
+
+	dir, err := ioutil.TempDir("", "gossh")
+	require.Nil(t, err)
+
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "known_hosts")
+
+	err = ioutil.WriteFile(file, []byte(knownhosts.Line([]string{"[localhost]:2222"}, hostKey.PublicKey())+"\n"), 0600)
+	require.Nil(t, err)
+
+	callback, err := KnownHostsCallback(file)
+	require.Nil(t, err)
+
+	// ssh-rsa alone is refused by OpenSSH 8.8 and later
+	algos := knownHostKeyAlgorithms(callback, "localhost", 2222, file)
+	require.Equal(t, []string{gossh.KeyAlgoRSASHA512, gossh.KeyAlgoRSASHA256, gossh.KeyAlgoRSA}, algos)
+
+	algos = knownHostKeyAlgorithms(callback, "otherhost", 2222, file)
+	require.Nil(t, algos)
+}
+
+func TestTrustOnFirstUse(t *testing.T) {
+	data, err := ioutil.ReadFile("./data/id_rsa")
+	require.Nil(t, err)
+
+	hostKey, err := gossh.ParsePrivateKey(data)
+	require.Nil(t, err)
+
+	data, err = ioutil.ReadFile("./data/ca.pub")
+	require.Nil(t, err)
+
+	otherKey, _, _, _, err := gossh.ParseAuthorizedKey(data)
+	require.Nil(t, err)
+
+	s := &ssh.Server{
+		Addr: ":2222",
+		Handler: func(s ssh.Session) {
+			fmt.Fprintf(s, "%s", strings.Join(s.Command(), " "))
+		},
+		HostSigners: []ssh.Signer{hostKey},
+		PasswordHandler: func(ctx ssh.Context, password string) bool {
+			return ctx.User() == "user" && password == "pass"
+		},
+	}
+	go s.ListenAndServe()
+
+	defer s.Close()
+
+	time.Sleep(3 * time.Second)
+
+	dir, err := ioutil.TempDir("", "gossh")
+	require.Nil(t, err)
+
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, ".ssh", "known_hosts")
+
+	config, err := NewClientConfigWithUserPass("user", "pass", "localhost", 2222, false)
+	require.Nil(t, err)
+
+	err = config.SetHostKeyPolicy(TrustOnFirstUse(file, true))
+	require.Nil(t, err)
+
+	// Unknown host: key recorded in hashed form
+	_, err = NewClient(config)
+	require.Nil(t, err)
+
+	content, err := ioutil.ReadFile(file)
+	require.Nil(t, err)
+	require.True(t, strings.HasPrefix(string(content), "|1|"))
+
+	// Known host: nothing new recorded
+	_, err = NewClient(config)
+	require.Nil(t, err)
+
+	recorded, err := ioutil.ReadFile(file)
+	require.Nil(t, err)
+	require.Equal(t, content, recorded)
+
+	// Key changed
+	err = ioutil.WriteFile(file, []byte(knownhosts.Line([]string{"[localhost]:2222"}, otherKey)+"\n"), 0600)
+	require.Nil(t, err)
+
+	_, err = NewClient(config)
+	require.NotNil(t, err)
+	require.Equal(t, "ssh: handshake failed: knownhosts: key mismatch", err.Error())
+}
+
+func TestKnownHostsCertAuthority(t *testing.T) {
+	data, err := ioutil.ReadFile("./data/id_rsa")
+	require.Nil(t, err)
+
+	hostKey, err := gossh.ParsePrivateKey(data)
+	require.Nil(t, err)
+
+	data, err = ioutil.ReadFile("./data/ca")
+	require.Nil(t, err)
+
+	ca, err := gossh.ParsePrivateKey(data)
+	require.Nil(t, err)
+
+	cert := &gossh.Certificate{
+		Key:             hostKey.PublicKey(),
+		Serial:          1,
+		CertType:        gossh.HostCert,
+		KeyId:           "localhost",
+		ValidPrincipals: []string{"localhost"},
+		ValidAfter:      uint64(time.Now().Add(-time.Minute).Unix()),
+		ValidBefore:     uint64(time.Now().Add(time.Hour).Unix()),
+	}
+
+	err = cert.SignCert(rand.Reader, ca)
+	require.Nil(t, err)
+
+	certSigner, err := gossh.NewCertSigner(cert, hostKey)
+	require.Nil(t, err)
+
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+
+	edKey, err := gossh.NewPublicKey(pub)
+	require.Nil(t, err)
+
+	// The server only presents its certificate
+	s := &ssh.Server{
+		Addr: ":2222",
+		Handler: func(s ssh.Session) {
+			fmt.Fprintf(s, "%s", strings.Join(s.Command(), " "))
+		},
+		HostSigners: []ssh.Signer{certSigner},
+		PasswordHandler: func(ctx ssh.Context, password string) bool {
+			return ctx.User() == "user" && password == "pass"
+		},
+	}
+	go s.ListenAndServe()
+
+	defer s.Close()
+
+	time.Sleep(3 * time.Second)
+
+	dir, err := ioutil.TempDir("", "gossh")
+	require.Nil(t, err)
+
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "known_hosts")
+
+	// Plain key of another type and authority of the host
+	knownHosts := knownhosts.Line([]string{"[localhost]:2222"}, edKey) + "\n" +
+		"@cert-authority [localhost]:2222 " + strings.TrimSpace(string(gossh.MarshalAuthorizedKey(ca.PublicKey()))) + "\n"
+
+	err = ioutil.WriteFile(file, []byte(knownHosts), 0600)
+	require.Nil(t, err)
+
+	_, algos, err := newKnownHostsConfig("localhost", 2222, file)
+	require.Nil(t, err)
+	require.Equal(t, append(append([]string{}, hostCertAlgorithms...), gossh.KeyAlgoED25519), algos)
+
+	// Authority of other hosts
+	_, algos, err = newKnownHostsConfig("otherhost", 2222, file)
+	require.Nil(t, err)
+	require.Nil(t, algos)
+
+	// Host only known by its authority
+	caFile := filepath.Join(dir, "known_hosts_ca")
+
+	err = ioutil.WriteFile(caFile, []byte(strings.SplitN(knownHosts, "\n", 2)[1]), 0600)
+	require.Nil(t, err)
+
+	_, algos, err = newKnownHostsConfig("localhost", 2222, caFile)
+	require.Nil(t, err)
+	require.Equal(t, hostCertAlgorithms, algos)
+
+	config, err := NewClientConfigWithUserPass("user", "pass", "localhost", 2222, false)
+	require.Nil(t, err)
+
+	err = config.SetHostKeyPolicy(KnownHosts(file))
+	require.Nil(t, err)
+
+	client, err := NewClient(config)
+	require.Nil(t, err)
+
+	defer client.Close()
+
+	cmd := "echo HelloWorld"
+	res, err := client.ExecCommand(cmd)
+	require.Nil(t, err)
+	require.Equal(t, cmd, string(res))
+}
@@ -0,0 +1,226 @@
+package gossh
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Option configures a Config built by NewConfig
+type Option func(c *Config) error
+
+// WithPort sets the port of the remote machine, 22 by default
+func WithPort(port int) Option {
+	return func(c *Config) error {
+		c.Port = port
+		return nil
+	}
+}
+
+// WithUser sets the user to authenticate as
+func WithUser(username string) Option {
+	return func(c *Config) error {
+		c.ClientConfig.User = username
+		return nil
+	}
+}
+
+// WithPassword adds the password authentication
+func WithPassword(password string) Option {
+	return func(c *Config) error {
+		c.ClientConfig.Auth = append(c.ClientConfig.Auth, ssh.Password(password))
+		return nil
+	}
+}
+
+// WithKeyboardInteractive adds the keyboard-interactive
+// authentication in which the questions asked by the server, for
+// example by PAM or for one-time passwords, are answered by the given
+// challenge function.
+//
+// Combined with public keys, it allows servers requiring
+// "publickey,keyboard-interactive" multi-step authentication.
+func WithKeyboardInteractive(challenge ssh.KeyboardInteractiveChallenge) Option {
+	return func(c *Config) error {
+		c.ClientConfig.Auth = append(c.ClientConfig.Auth, ssh.KeyboardInteractive(challenge))
+		return nil
+	}
+}
+
+// WithKeyFile adds the private key in the given file to the keys
+// offered for the public key authentication
+func WithKeyFile(keyFile string) Option {
+	return func(c *Config) error {
+		c.identities = append(c.identities, identity{keyFile: keyFile})
+		return nil
+	}
+}
+
+// WithCertificate adds the private key in the given file along with
+// its public key signed by a CA to the keys offered for the public
+// key authentication
+func WithCertificate(keyFile, certFile string) Option {
+	return func(c *Config) error {
+		c.identities = append(c.identities, identity{keyFile: keyFile, certFile: certFile})
+		return nil
+	}
+}
+
+// WithPassphrase sets the passphrase decrypting the encrypted
+// private keys given by WithKeyFile and WithCertificate
+func WithPassphrase(passphrase []byte) Option {
+	return func(c *Config) error {
+		c.passphraseProvider = func(keyFile string) ([]byte, error) {
+			return passphrase, nil
+		}
+
+		return nil
+	}
+}
+
+// WithPassphraseProvider sets the function returning the passphrase
+// of each encrypted private key given by WithKeyFile and
+// WithCertificate, for example PromptPassphrase
+func WithPassphraseProvider(provider PassphraseProvider) Option {
+	return func(c *Config) error {
+		c.passphraseProvider = provider
+		return nil
+	}
+}
+
+// WithSigner adds the given signer to the keys offered for the public
+// key authentication
+func WithSigner(signer ssh.Signer) Option {
+	return func(c *Config) error {
+		c.signers = append(c.signers, signer)
+		return nil
+	}
+}
+
+// WithAgent adds the keys and certificates of the running ssh-agent,
+// reached through SSH_AUTH_SOCK, to the keys offered for the public
+// key authentication
+func WithAgent() Option {
+	return func(c *Config) error {
+		socket, err := agentSocket()
+		if err != nil {
+			return err
+		}
+
+		c.agentSocket = socket
+		c.agentAuth = true
+
+		return nil
+	}
+}
+
+// WithAgentForwarding forwards the running ssh-agent, reached through
+// SSH_AUTH_SOCK, to the remote machine in the sessions executing
+// commands. It allows for example git clones with the local keys.
+func WithAgentForwarding() Option {
+	return func(c *Config) error {
+		socket, err := agentSocket()
+		if err != nil {
+			return err
+		}
+
+		c.agentSocket = socket
+		c.forwardAgent = true
+
+		return nil
+	}
+}
+
+// WithHostKeyPolicy sets the policy verifying the key presented by
+// the remote machine, KnownHosts() by default
+func WithHostKeyPolicy(policy HostKeyPolicy) Option {
+	return func(c *Config) error {
+		c.hostKeyPolicy = policy
+		return nil
+	}
+}
+
+// WithJumpHost adds a jump host, or bastion, to go through in order
+// to reach the host. Jump hosts are connected to in the order of the
+// options.
+func WithJumpHost(jump *Config) Option {
+	return func(c *Config) error {
+		c.JumpHosts = append(c.JumpHosts, jump)
+		return nil
+	}
+}
+
+// WithDialer sets the dialer establishing the network connection,
+// for example SOCKS5Dialer or HTTPConnectDialer to go through a proxy
+func WithDialer(dialer Dialer) Option {
+	return func(c *Config) error {
+		c.Dialer = dialer
+		return nil
+	}
+}
+
+// WithTimeout sets the maximum amount of time for the TCP
+// connection to establish
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Config) error {
+		c.ClientConfig.Timeout = timeout
+		return nil
+	}
+}
+
+// WithKeepalive sends keepalive@openssh.com requests every interval
+// to keep the connection open through NATs and firewalls, and to
+// detect dead connections: the connection is closed after maxMissed
+// requests without reply, 3 if 0.
+func WithKeepalive(interval time.Duration, maxMissed int) Option {
+	return func(c *Config) error {
+		if interval <= 0 {
+			return fmt.Errorf("keepalive interval must be positive")
+		}
+
+		if maxMissed <= 0 {
+			maxMissed = defaultKeepaliveMaxMissed
+		}
+
+		c.keepaliveInterval = interval
+		c.keepaliveMaxMissed = maxMissed
+
+		return nil
+	}
+}
+
+// WithReconnect re-establishes the connection, when it is lost, before
+// starting new sessions, following the given policy. Sessions
+// running when the connection is lost fail.
+func WithReconnect(policy ReconnectPolicy) Option {
+	return func(c *Config) error {
+		c.reconnect = &policy
+		return nil
+	}
+}
+
+// WithCiphers sets the allowed cipher algorithms
+func WithCiphers(ciphers ...string) Option {
+	return func(c *Config) error {
+		c.ClientConfig.Ciphers = ciphers
+		return nil
+	}
+}
+
+// WithKeyExchanges sets the allowed key exchange algorithms
+func WithKeyExchanges(kex ...string) Option {
+	return func(c *Config) error {
+		c.ClientConfig.KeyExchanges = kex
+		return nil
+	}
+}
+
+// WithBannerCallback sets the function handling the banner sent by
+// the remote machine
+func WithBannerCallback(callback ssh.BannerCallback) Option {
+	return func(c *Config) error {
+		c.ClientConfig.BannerCallback = callback
+		return nil
+	}
+}
@@ -0,0 +1,74 @@
+package gossh
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// PromptPassphrase is a PassphraseProvider asking the passphrase
+// of the private key on the terminal
+func PromptPassphrase(keyFile string) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, fmt.Errorf("cannot prompt the passphrase of %s: stdin is not a terminal", keyFile)
+	}
+
+	fmt.Fprintf(os.Stderr, "Enter passphrase for key '%s': ", keyFile)
+
+	passphrase, err := term.ReadPassword(fd)
+
+	fmt.Fprintln(os.Stderr)
+
+	return passphrase, err
+}
+
+// PromptKeyboardInteractive is a keyboard-interactive challenge
+// asking the questions of the server on the terminal. Answers which
+// must not be echoed, such as passwords or one-time passwords, are
+// read without echo.
+func PromptKeyboardInteractive(name, instruction string, questions []string, echos []bool) ([]string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, fmt.Errorf("cannot prompt keyboard-interactive questions: stdin is not a terminal")
+	}
+
+	for _, line := range []string{name, instruction} {
+		if line != "" {
+			fmt.Fprintln(os.Stderr, line)
+		}
+	}
+
+	answers := make([]string, len(questions))
+	reader := bufio.NewReader(os.Stdin)
+
+	for i, question := range questions {
+		fmt.Fprint(os.Stderr, question)
+
+		if echos[i] {
+			answer, err := reader.ReadString('\n')
+			if err != nil {
+				return nil, err
+			}
+
+			answers[i] = strings.TrimRight(answer, "\r\n")
+
+			continue
+		}
+
+		answer, err := term.ReadPassword(fd)
+
+		fmt.Fprintln(os.Stderr)
+
+		if err != nil {
+			return nil, err
+		}
+
+		answers[i] = string(answer)
+	}
+
+	return answers, nil
+}
@@ -0,0 +1,142 @@
+package gossh
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// Default terminal used when a PTY does not specify it
+const (
+	defaultTerm   = "xterm"
+	defaultWidth  = 80
+	defaultHeight = 24
+)
+
+// PTY is a pseudo-terminal requested for a command, needed by
+// programs such as top, interactive installers or sudo with
+// requiretty
+type PTY struct {
+	// Term is the terminal type, such as xterm-256color, xterm if
+	// empty
+	Term string
+
+	// Width and Height are the size of the terminal in characters,
+	// 80x24 if 0
+	Width  int
+	Height int
+
+	// Modes are the terminal modes, echo enabled with a speed of
+	// 14400 baud if nil
+	Modes ssh.TerminalModes
+}
+
+// WithPTY requests a pseudo-terminal for the command. Its size can be
+// changed with Cmd.Resize. As the remote terminal merges stdout and
+// stderr, all the output is received on stdout.
+func WithPTY(pty PTY) ExecOption {
+	return func(o *execOptions) {
+		o.pty = &pty
+	}
+}
+
+// Resize changes the size of the pseudo-terminal of the command,
+// started with WithPTY
+func (cmd *Cmd) Resize(width, height int) error {
+	return cmd.session.WindowChange(height, width)
+}
+
+// Shell starts an interactive shell on the remote machine, attached
+// to the local terminal set in raw mode, and returns when the shell
+// ends. Resizes of the local terminal are propagated.
+func (c *Client) Shell() error {
+	return c.ShellContext(context.Background())
+}
+
+// ShellContext is Shell closing the shell when ctx is done
+func (c *Client) ShellContext(ctx context.Context) error {
+	fd := int(os.Stdin.Fd())
+
+	if !term.IsTerminal(fd) {
+		return fmt.Errorf("stdin is not a terminal")
+	}
+
+	width, height, err := term.GetSize(fd)
+	if err != nil {
+		width, height = defaultWidth, defaultHeight
+	}
+
+	ctx, cancel := c.context(ctx)
+	defer cancel()
+
+	session, err := c.newExecSession(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	err = requestPTY(session, &PTY{Term: os.Getenv("TERM"), Width: width, Height: height})
+	if err != nil {
+		return err
+	}
+
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return fmt.Errorf("failed to set terminal in raw mode: err=%s", err)
+	}
+	defer term.Restore(fd, state)
+
+	session.Stdin = os.Stdin
+	session.Stdout = os.Stdout
+	session.Stderr = os.Stderr
+
+	err = session.Shell()
+	if err != nil {
+		return err
+	}
+
+	stop := watchWindowSize(fd, session)
+	defer stop()
+
+	return waitSession(ctx, session)
+}
+
+///////// INTERNAL FUNCTIONS ////////////////////////////
+
+// requestPTY requests a pseudo-terminal for the session, with the
+// default values for the settings not given
+func requestPTY(session *ssh.Session, pty *PTY) error {
+	termType := pty.Term
+	if termType == "" {
+		termType = defaultTerm
+	}
+
+	width := pty.Width
+	if width <= 0 {
+		width = defaultWidth
+	}
+
+	height := pty.Height
+	if height <= 0 {
+		height = defaultHeight
+	}
+
+	modes := pty.Modes
+	if modes == nil {
+		modes = ssh.TerminalModes{
+			ssh.ECHO:          1,
+			ssh.TTY_OP_ISPEED: 14400,
+			ssh.TTY_OP_OSPEED: 14400,
+		}
+	}
+
+	err := session.RequestPty(termType, height, width, modes)
+	if err != nil {
+		return fmt.Errorf("failed to request a pseudo-terminal: err=%s", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,83 @@
+package gossh
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPTY(t *testing.T) {
+	s := &ssh.Server{
+		Addr: ":2222",
+		Handler: func(s ssh.Session) {
+			pty, winCh, isPty := s.Pty()
+			if !isPty {
+				fmt.Fprint(s, "no pty")
+				return
+			}
+
+			fmt.Fprintf(s, "%s %dx%d\n", pty.Term, pty.Window.Width, pty.Window.Height)
+
+			// First window is the initial size
+			<-winCh
+			win := <-winCh
+
+			fmt.Fprintf(s, "%dx%d\n", win.Width, win.Height)
+		},
+		PasswordHandler: func(ctx ssh.Context, password string) bool {
+			return ctx.User() == "user" && password == "pass"
+		},
+	}
+	go s.ListenAndServe()
+
+	defer s.Close()
+
+	time.Sleep(3 * time.Second)
+
+	testCases := []struct {
+		name   string
+		pty    PTY
+		output interface{}
+	}{
+		{
+			"OK",
+			PTY{Term: "vt100", Width: 100, Height: 40},
+			"vt100 100x40\r\n120x50\r\n",
+		},
+		{
+			"OKDefault",
+			PTY{},
+			"xterm 80x24\r\n120x50\r\n",
+		},
+	}
+
+	config, err := NewClientConfigWithUserPass("user", "pass", "localhost", 2222, false)
+	require.Nil(t, err)
+
+	client, err := NewClient(config)
+	require.Nil(t, err)
+
+	defer client.Close()
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cmd, err := client.Start("tty", WithPTY(tc.pty))
+			require.Nil(t, err)
+
+			err = cmd.Resize(120, 50)
+			require.Nil(t, err)
+
+			res, err := cmd.Wait()
+			require.Nil(t, err)
+			require.Equal(t, tc.output, string(res.Stdout))
+		})
+	}
+
+	// No terminal attached to the tests
+	err = client.Shell()
+	require.Equal(t, "stdin is not a terminal", err.Error())
+}
@@ -0,0 +1,41 @@
+//go:build !windows
+
+package gossh
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// watchWindowSize sends the new size of the local terminal to the
+// session when it receives SIGWINCH, until the returned function is
+// called
+func watchWindowSize(fd int, session *ssh.Session) func() {
+	sigs := make(chan os.Signal, 1)
+	done := make(chan struct{})
+
+	signal.Notify(sigs, syscall.SIGWINCH)
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-sigs:
+				width, height, err := term.GetSize(fd)
+				if err == nil {
+					session.WindowChange(height, width)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(sigs)
+		close(done)
+	}
+}
@@ -0,0 +1,46 @@
+//go:build windows
+
+package gossh
+
+import (
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// Interval between two checks of the size of the local terminal
+const windowSizePollInterval = 500 * time.Millisecond
+
+// watchWindowSize sends the new size of the local terminal to the
+// session when it changes, until the returned function is called.
+// Windows has no SIGWINCH: the size is polled.
+func watchWindowSize(fd int, session *ssh.Session) func() {
+	done := make(chan struct{})
+
+	go func() {
+		width, height, _ := term.GetSize(fd)
+
+		ticker := time.NewTicker(windowSizePollInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				w, h, err := term.GetSize(fd)
+				if err != nil || (w == width && h == height) {
+					continue
+				}
+
+				width, height = w, h
+				session.WindowChange(height, width)
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+	}
+}
@@ -0,0 +1,65 @@
+package gossh
+
+import (
+	"strings"
+)
+
+// QuoteCommand returns the command line executing the program with
+// the given arguments, each of them quoted for POSIX shells. It can
+// be given to Run or Start.
+func QuoteCommand(name string, args ...string) string {
+	quoted := make([]string, 0, len(args)+1)
+
+	for _, arg := range append([]string{name}, args...) {
+		quoted = append(quoted, shellQuote(arg))
+	}
+
+	return strings.Join(quoted, " ")
+}
+
+///////// INTERNAL FUNCTIONS ////////////////////////////
+
+// shellQuote quotes the string for POSIX shells: it is enclosed in
+// single quotes, the single quotes it contains being escaped outside
+// of them. Strings made only of safe characters are left as is.
+func shellQuote(s string) string {
+	if s == "" {
+		return "''"
+	}
+
+	safe := true
+
+	for _, r := range s {
+		if !isSafeShellChar(r) {
+			safe = false
+			break
+		}
+	}
+
+	if safe {
+		return s
+	}
+
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// shellQuotePath quotes the path as shellQuote, keeping a leading
+// ~/ unquoted so that it is still expanded to the home directory
+func shellQuotePath(path string) string {
+	if strings.HasPrefix(path, "~/") {
+		return "~/" + shellQuote(path[2:])
+	}
+
+	return shellQuote(path)
+}
+
+// isSafeShellChar returns true for the characters which do not need
+// to be quoted
+func isSafeShellChar(r rune) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		return true
+	}
+
+	return strings.ContainsRune("@%+=:,./-_", r)
+}
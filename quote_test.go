@@ -0,0 +1,37 @@
+package gossh
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuoteCommand(t *testing.T) {
+	testCases := []struct {
+		name   string
+		args   []string
+		output interface{}
+	}{
+		{
+			"OKSafe",
+			[]string{"ls", "-la", "/tmp/dir_1"},
+			"ls -la /tmp/dir_1",
+		},
+		{
+			"OKSpaces",
+			[]string{"touch", "my file", ""},
+			"touch 'my file' ''",
+		},
+		{
+			"OKMetacharacters",
+			[]string{"echo", "$(reboot); `id` | cat > /etc/passwd", "it's"},
+			`echo '$(reboot); ` + "`id`" + ` | cat > /etc/passwd' 'it'\''s'`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.output, QuoteCommand(tc.args[0], tc.args[1:]...))
+		})
+	}
+}
@@ -0,0 +1,347 @@
+package gossh
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// RemoteFS is the filesystem of the remote machine, accessed through
+// the sftp subsystem. It implements fs.FS, fs.ReadDirFS and fs.StatFS
+// so that fs.WalkDir, fs.Glob or template.ParseFS work with remote
+// files.
+//
+// Names are slash-separated paths relative to the root given to
+// NewRemoteFS, as with os.DirFS.
+type RemoteFS struct {
+	root    string
+	session *ssh.Session
+	client  *sftp.Client
+}
+
+// umask is applied to the modes of the files and directories created
+// by RemoteFS, as by os.OpenFile and os.MkdirAll with the usual umask
+const umask fs.FileMode = 022
+
+// File is a remote file opened for writing by RemoteFS
+type File interface {
+	fs.File
+	io.Writer
+	io.Seeker
+}
+
+// NewRemoteFS opens a filesystem rooted at the given directory of the
+// remote machine. It must be closed after use.
+func NewRemoteFS(client *Client, root string) (*RemoteFS, error) {
+	return NewRemoteFSContext(context.Background(), client, root)
+}
+
+// NewRemoteFSContext is NewRemoteFS aborting the opening of the
+// filesystem, and the reconnection it may need, when ctx is done.
+// ctx has no effect once the filesystem is opened.
+func NewRemoteFSContext(ctx context.Context, client *Client, root string) (*RemoteFS, error) {
+	if client.become != nil {
+		return nil, errors.New("privilege escalation is not supported by sftp")
+	}
+
+	ctx, cancel := client.context(ctx)
+	defer cancel()
+
+	session, err := client.newSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var sftpClient *sftp.Client
+
+	started := make(chan error, 1)
+
+	go func() {
+		var err error
+
+		sftpClient, err = startSFTP(session)
+		started <- err
+	}()
+
+	// Closing the session unblocks the initialization
+	select {
+	case err = <-started:
+	case <-ctx.Done():
+		session.Close()
+
+		if <-started == nil {
+			sftpClient.Close()
+		}
+
+		return nil, context.Cause(ctx)
+	}
+
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	f := &RemoteFS{
+		root:    root,
+		session: session,
+		client:  sftpClient,
+	}
+
+	return f, nil
+}
+
+// Close closes the sftp session of the filesystem
+func (f *RemoteFS) Close() error {
+	err := f.client.Close()
+
+	f.session.Close()
+
+	return err
+}
+
+// Open opens the named file or directory for reading
+func (f *RemoteFS) Open(name string) (fs.File, error) {
+	p, err := f.path("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.client.Stat(p)
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+
+	if info.IsDir() {
+		return &remoteDir{fs: f, name: name, info: info}, nil
+	}
+
+	file, err := f.client.Open(p)
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+
+	return file, nil
+}
+
+// ReadDir returns the entries of the named directory sorted by name
+func (f *RemoteFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	p, err := f.path("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+
+	infos, err := f.client.ReadDir(p)
+	if err != nil {
+		return nil, pathError("readdir", name, err)
+	}
+
+	entries := make([]fs.DirEntry, 0, len(infos))
+	for _, info := range infos {
+		entries = append(entries, fs.FileInfoToDirEntry(info))
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+
+	return entries, nil
+}
+
+// Stat returns the information of the named file. Symbolic links
+// are followed.
+func (f *RemoteFS) Stat(name string) (fs.FileInfo, error) {
+	p, err := f.path("stat", name)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.client.Stat(p)
+	if err != nil {
+		return nil, pathError("stat", name, err)
+	}
+
+	return info, nil
+}
+
+// Create creates or truncates the named file, with mode 0666 before
+// umask
+func (f *RemoteFS) Create(name string) (File, error) {
+	return f.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// OpenFile opens the named file with the flags of os.OpenFile. perm
+// is the mode of the file if it is created, before umask.
+func (f *RemoteFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	p, err := f.path("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	created := false
+
+	if flag&os.O_CREATE != 0 {
+		_, err = f.client.Stat(p)
+		created = errors.Is(err, fs.ErrNotExist)
+	}
+
+	file, err := f.client.OpenFile(p, flag)
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+
+	if created {
+		err = file.Chmod(perm &^ umask)
+		if err != nil {
+			file.Close()
+			return nil, pathError("chmod", name, err)
+		}
+	}
+
+	// Servers write at the offsets given by the client, whatever the
+	// append flag
+	if flag&os.O_APPEND != 0 {
+		_, err = file.Seek(0, io.SeekEnd)
+		if err != nil {
+			file.Close()
+			return nil, pathError("seek", name, err)
+		}
+	}
+
+	return file, nil
+}
+
+// MkdirAll creates the named directory with its missing parents,
+// with the given mode before umask
+func (f *RemoteFS) MkdirAll(name string, perm fs.FileMode) error {
+	_, err := f.path("mkdir", name)
+	if err != nil {
+		return err
+	}
+
+	dir := f.root
+
+	for _, elem := range strings.Split(name, "/") {
+		dir = path.Join(dir, elem)
+
+		info, err := f.client.Stat(dir)
+		if err == nil {
+			if !info.IsDir() {
+				return pathError("mkdir", name, errors.New("not a directory"))
+			}
+
+			continue
+		}
+
+		err = f.client.Mkdir(dir)
+		if err == nil {
+			err = f.client.Chmod(dir, perm&^umask)
+		}
+
+		if err != nil {
+			return pathError("mkdir", name, err)
+		}
+	}
+
+	return nil
+}
+
+// Remove removes the named file or empty directory
+func (f *RemoteFS) Remove(name string) error {
+	p, err := f.path("remove", name)
+	if err != nil {
+		return err
+	}
+
+	err = f.client.Remove(p)
+	if err != nil {
+		return pathError("remove", name, err)
+	}
+
+	return nil
+}
+
+///////// INTERNAL FUNCTIONS ////////////////////////////
+
+// remoteDir is a remote directory opened by RemoteFS.Open
+type remoteDir struct {
+	fs      *RemoteFS
+	name    string
+	info    fs.FileInfo
+	entries []fs.DirEntry
+	read    bool
+}
+
+func (d *remoteDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *remoteDir) Read(b []byte) (int, error) {
+	return 0, pathError("read", d.name, errors.New("is a directory"))
+}
+
+func (d *remoteDir) Close() error {
+	return nil
+}
+
+// ReadDir returns the next n entries of the directory, all the
+// remaining ones if n <= 0
+func (d *remoteDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		entries, err := d.fs.ReadDir(d.name)
+		if err != nil {
+			return nil, err
+		}
+
+		d.entries = entries
+		d.read = true
+	}
+
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+
+		return entries, nil
+	}
+
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+
+	return entries, nil
+}
+
+// path returns the remote path of the name after checking it is
+// valid for fs.FS
+func (f *RemoteFS) path(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	return path.Join(f.root, name), nil
+}
+
+// pathError returns the error of the operation on the name, with
+// the paths of the remote machine hidden
+func pathError(op, name string, err error) error {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		err = pathErr.Err
+	}
+
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
@@ -0,0 +1,154 @@
+package gossh
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoteFS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gossh")
+	require.Nil(t, err)
+
+	defer os.RemoveAll(dir)
+
+	err = os.MkdirAll(dir+"/templates/partials", 0755)
+	require.Nil(t, err)
+
+	err = ioutil.WriteFile(dir+"/templates/index.tmpl", []byte("{{ .Title }}"), 0644)
+	require.Nil(t, err)
+
+	err = ioutil.WriteFile(dir+"/templates/partials/footer.tmpl", []byte("Footer"), 0600)
+	require.Nil(t, err)
+
+	s := &ssh.Server{
+		Addr: ":2222",
+		SubsystemHandlers: map[string]ssh.SubsystemHandler{
+			"sftp": sftpHandler,
+		},
+		PasswordHandler: func(ctx ssh.Context, password string) bool {
+			return ctx.User() == "user" && password == "pass"
+		},
+	}
+	go s.ListenAndServe()
+
+	defer s.Close()
+
+	time.Sleep(3 * time.Second)
+
+	config, err := NewClientConfigWithUserPass("user", "pass", "localhost", 2222, false)
+	require.Nil(t, err)
+
+	client, err := NewClient(config)
+	require.Nil(t, err)
+
+	defer client.Close()
+
+	remoteFS, err := NewRemoteFS(client, dir)
+	require.Nil(t, err)
+
+	defer remoteFS.Close()
+
+	// Reading
+	err = fstest.TestFS(remoteFS, "templates/index.tmpl", "templates/partials/footer.tmpl")
+	require.Nil(t, err)
+
+	matches, err := fs.Glob(remoteFS, "templates/*.tmpl")
+	require.Nil(t, err)
+	require.Equal(t, []string{"templates/index.tmpl"}, matches)
+
+	content, err := fs.ReadFile(remoteFS, "templates/partials/footer.tmpl")
+	require.Nil(t, err)
+	require.Equal(t, "Footer", string(content))
+
+	_, err = remoteFS.Stat("templates/missing")
+	require.True(t, errors.Is(err, fs.ErrNotExist))
+	require.Equal(t, "stat templates/missing: file does not exist", err.Error())
+
+	_, err = remoteFS.Open("../etc/passwd")
+	require.True(t, errors.Is(err, fs.ErrInvalid))
+
+	// Writing
+	err = remoteFS.MkdirAll("out/site", 0700)
+	require.Nil(t, err)
+
+	file, err := remoteFS.Create("out/site/index.html")
+	require.Nil(t, err)
+
+	_, err = io.WriteString(file, "<h1>Title</h1>")
+	require.Nil(t, err)
+
+	err = file.Close()
+	require.Nil(t, err)
+
+	content, err = ioutil.ReadFile(dir + "/out/site/index.html")
+	require.Nil(t, err)
+	require.Equal(t, "<h1>Title</h1>", string(content))
+
+	info, err := os.Stat(dir + "/out/site")
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0700), info.Mode().Perm())
+
+	// Modes of the created files with umask 022
+	info, err = os.Stat(dir + "/out/site/index.html")
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0644), info.Mode().Perm())
+
+	file, err = remoteFS.OpenFile("out/site/script.sh", os.O_WRONLY|os.O_CREATE, 0777)
+	require.Nil(t, err)
+
+	err = file.Close()
+	require.Nil(t, err)
+
+	info, err = os.Stat(dir + "/out/site/script.sh")
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0755), info.Mode().Perm())
+
+	err = remoteFS.MkdirAll("out/shared", 0777)
+	require.Nil(t, err)
+
+	info, err = os.Stat(dir + "/out/shared")
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0755), info.Mode().Perm())
+
+	file, err = remoteFS.OpenFile("out/site/index.html", os.O_WRONLY|os.O_APPEND, 0)
+	require.Nil(t, err)
+
+	_, err = io.WriteString(file, "\n")
+	require.Nil(t, err)
+
+	err = file.Close()
+	require.Nil(t, err)
+
+	content, err = ioutil.ReadFile(dir + "/out/site/index.html")
+	require.Nil(t, err)
+	require.Equal(t, "<h1>Title</h1>\n", string(content))
+
+	err = remoteFS.Remove("out/site/index.html")
+	require.Nil(t, err)
+
+	_, err = os.Stat(dir + "/out/site/index.html")
+	require.True(t, os.IsNotExist(err))
+
+	// Opening aborted
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = NewRemoteFSContext(ctx, client, dir)
+	require.Equal(t, context.Canceled, err)
+
+	client.Close()
+
+	_, err = NewRemoteFS(client, dir)
+	require.Equal(t, ErrClientClosed, err)
+}
@@ -3,12 +3,14 @@ package gossh
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -23,7 +25,7 @@ const (
 	msgCopyFile = "C"
 	msgStartDir = "D"
 	msgEndDir   = "E"
-	//msgTime     = "T"
+	msgTime     = "T"
 
 	// reply or send to end tranfer
 	msgOK       = '\x00'
@@ -46,17 +48,68 @@ const (
 	bufferSizeDataFile = 1024
 )
 
+// SCPOption configures the transfers of the SCP methods
+type SCPOption func(o *scpOptions)
+
+// UnknownSize is the way SCPSendReader uploads the content of
+// a reader whose size is unknown, scp requiring it beforehand
+type UnknownSize int
+
+const (
+	// UnknownSizeSpool writes the content to a local temporary file
+	// first, then sends the file
+	UnknownSizeSpool UnknownSize = iota
+	// UnknownSizeCat streams the content to cat on the remote
+	// machine, without scp
+	UnknownSizeCat
+)
+
+type scpOptions struct {
+	preserveTimes bool
+	unknownSize   UnknownSize
+}
+
+// WithPreserveTimes keeps the modification and access times of the
+// transferred files and directories, as scp -p
+func WithPreserveTimes() SCPOption {
+	return func(o *scpOptions) {
+		o.preserveTimes = true
+	}
+}
+
+// WithUnknownSize sets how SCPSendReader uploads a content of unknown
+// size, UnknownSizeSpool by default. With sftp, the content is always
+// streamed.
+func WithUnknownSize(strategy UnknownSize) SCPOption {
+	return func(o *scpOptions) {
+		o.unknownSize = strategy
+	}
+}
+
+// SCPFileInfo describes a remote file as announced before its
+// content
+type SCPFileInfo struct {
+	Name string
+	Mode os.FileMode
+	Size int64
+}
+
 type scpSession struct {
 	session *ssh.Session
 	in      io.WriteCloser
 	out     io.Reader
 	err     io.Reader
-	timeout time.Duration
+
+	// Transfers are aborted when ctx is done
+	ctx context.Context
+
+	// Send and apply the times of the files with T messages
+	preserveTimes bool
 
 	myClient *Client
 }
 
-func newSCPSession(client *Client, session *ssh.Session) (*scpSession, error) {
+func newSCPSession(ctx context.Context, client *Client, session *ssh.Session) (*scpSession, error) {
 	in, err := session.StdinPipe()
 	if err != nil {
 		return nil, err
@@ -77,7 +130,7 @@ func newSCPSession(client *Client, session *ssh.Session) (*scpSession, error) {
 		in:       in,
 		out:      out,
 		err:      e,
-		timeout:  time.Minute * 15,
+		ctx:      ctx,
 		myClient: client,
 	}
 
@@ -98,6 +151,18 @@ func (s *scpSession) SendBytes(content []byte, remoteFile, mode string) error {
 	})
 }
 
+// SendReader creates a file with given name and the size bytes read
+// from r as content on remote host
+func (s *scpSession) SendReader(r io.Reader, size int64, remoteFile, mode string) error {
+	if mode == "" {
+		mode = "0755"
+	}
+
+	return s.execSCPSession(SCPFILE, remoteFile, func() error {
+		return s.sendFile(mode, size, remoteFile, ioutil.NopCloser(&sizedReader{r: r, remain: size}))
+	})
+}
+
 // SendFile checks and reads content of a local file
 // and send it to remote machine
 func (s *scpSession) SendFile(localFile, remoteFile, mode string) error {
@@ -126,6 +191,11 @@ func (s *scpSession) SendFile(localFile, remoteFile, mode string) error {
 	}
 
 	return s.execSCPSession(SCPFILE, remoteFile, func() error {
+		err := s.sendTimes(fileInfo)
+		if err != nil {
+			return err
+		}
+
 		return s.sendFile(mode, fileInfo.Size(), remoteFile, file)
 	})
 }
@@ -164,10 +234,8 @@ func (s *scpSession) GetFile(remoteFile, localFile string) error {
 		if err != nil {
 			return err
 		}
-	} else {
-		if fileInfo.IsDir() {
-			localFile = localFolder + "/" + remoteFilename
-		}
+	} else if err == nil && fileInfo.IsDir() {
+		localFile = filepath.Join(localFile, remoteFilename)
 	}
 
 	return s.execSCPSession(SCPGETFILE, remoteFile, func() error {
@@ -175,6 +243,21 @@ func (s *scpSession) GetFile(remoteFile, localFile string) error {
 	})
 }
 
+// GetToWriter gets the remote file and writes its content to w
+func (s *scpSession) GetToWriter(remoteFile string, w io.Writer) (*SCPFileInfo, error) {
+	var info *SCPFileInfo
+
+	err := s.execSCPSession(SCPGETFILE, path.Clean(remoteFile), func() error {
+		var err error
+
+		info, err = s.getToWriter(w)
+
+		return err
+	})
+
+	return info, err
+}
+
 // GetDir gets remote folder's contents and save them to the local folder.
 // remoteDir must be the path to a the folder to download.
 // localDir must be the path to the local folder in which all subfolders and files
@@ -235,12 +318,27 @@ func (s *scpSession) sendDir(localDir, remoteDir, mode string) error {
 	remoteDir = filepath.Clean(remoteDir)
 	dirName := filepath.Base(localDir)
 
+	// Stat before reading, which updates the access time
+	dirInfo, err := os.Stat(localDir)
+	if err != nil {
+		return err
+	}
+
 	// Read & check if localDir is a directory
 	files, err := ioutil.ReadDir(localDir)
 	if err != nil {
 		return err
 	}
 
+	if mode == "" {
+		mode = fmt.Sprintf("%#4o", dirInfo.Mode()&os.ModePerm)
+	}
+
+	err = s.sendTimes(dirInfo)
+	if err != nil {
+		return err
+	}
+
 	// new remote dir
 	newRemoteDir := remoteDir + "/" + dirName
 	// Create a new directory inside remoteDir
@@ -272,6 +370,11 @@ func (s *scpSession) sendDir(localDir, remoteDir, mode string) error {
 
 			mode := fmt.Sprintf("%#4o", file.Mode()&os.ModePerm)
 
+			err = s.sendTimes(file)
+			if err != nil {
+				return err
+			}
+
 			err = s.sendFile(mode, file.Size(), remoteFile, fileLocal)
 			if err != nil {
 				return err
@@ -288,6 +391,21 @@ func (s *scpSession) sendDir(localDir, remoteDir, mode string) error {
 	return nil
 }
 
+// sendTimes sends the modification and access times of the file
+// or directory sent next, if they are preserved
+func (s *scpSession) sendTimes(info os.FileInfo) error {
+	if !s.preserveTimes {
+		return nil
+	}
+
+	_, err := fmt.Fprintf(s.in, "%s%d 0 %d 0\n", msgTime, info.ModTime().Unix(), fileAccessTime(info).Unix())
+	if err != nil {
+		return fmt.Errorf("error while sending times: err=%s", err)
+	}
+
+	return s.readReply()
+}
+
 // startDirectory starts a recursive directory
 func (s *scpSession) startDirectory(mode string, remoteDir string) error {
 	dirname := filepath.Base(remoteDir)
@@ -312,29 +430,83 @@ func (s *scpSession) endDirectory() error {
 
 // getFile gets a remote file and writes its content to the given local file
 func (s *scpSession) getFile(localFile string) error {
-	//var err error
-	var msg string
-	var fields []string
+	_, err := s.receiveFile(func(info *SCPFileInfo, times *scpTimes, data func(w io.Writer) error) error {
+		f, err := os.OpenFile(localFile, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, info.Mode)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		err = data(f)
+		if err != nil {
+			return err
+		}
+
+		err = f.Sync()
+		if err != nil {
+			return err
+		}
+
+		return times.apply(localFile)
+	})
+
+	return err
+}
+
+// getToWriter gets a remote file and writes its content to w
+func (s *scpSession) getToWriter(w io.Writer) (*SCPFileInfo, error) {
+	return s.receiveFile(func(info *SCPFileInfo, times *scpTimes, data func(w io.Writer) error) error {
+		return data(w)
+	})
+}
+
+// receiveFile receives a single file. The handler is given its
+// header, its times if sent, and the function copying its data.
+func (s *scpSession) receiveFile(handler func(info *SCPFileInfo, times *scpTimes, data func(w io.Writer) error) error) (*SCPFileInfo, error) {
+	var times *scpTimes
 
 	reader := bufio.NewReader(s.out)
 
-	buffer, n, err := s.readMessage(reader)
-	if err != nil {
-		return err
-	}
+	for {
+		buffer, n, err := s.readMessage(reader)
+		if err != nil {
+			return nil, err
+		}
 
-	msgType := string(buffer[0])
+		msgType := string(buffer[0])
 
-	if msgType == msgCopyFile {
-		msg = string(buffer[1 : n-1])
-		fields = strings.Split(msg, " ")
+		if msgType == msgTime {
+			times, err = parseTimes(buffer[1 : n-1])
+			if err != nil {
+				return nil, err
+			}
 
-		return s.readFileData(reader, localFile, os.FileMode(cast.ToUint32(fields[0])), cast.ToInt(fields[1]))
-	} else if buffer[0] == msgErr || buffer[0] == msgFatalErr {
-		return fmt.Errorf("%s", string(buffer[1:n]))
-	}
+			continue
+		}
 
-	return fmt.Errorf("expected message type '%s', received '%s'", msgCopyFile, msgType)
+		if msgType == msgCopyFile {
+			info, err := parseFileHeader(buffer[1 : n-1])
+			if err != nil {
+				return nil, err
+			}
+
+			err = handler(info, times, func(w io.Writer) error {
+				return s.readData(reader, w, info.Size)
+			})
+			if err != nil {
+				return nil, err
+			}
+
+			// Acknowledge the end of the file for scp to exit
+			_, err = s.in.Write([]byte{msgOK})
+
+			return info, err
+		} else if buffer[0] == msgErr || buffer[0] == msgFatalErr {
+			return nil, fmt.Errorf("%s", string(buffer[1:n]))
+		}
+
+		return nil, fmt.Errorf("expected message type '%s', received '%s'", msgCopyFile, msgType)
+	}
 }
 
 // getDir gets a remote folder and writes its contents to the given local folder
@@ -347,6 +519,11 @@ func (s *scpSession) getDir(localDir string) error {
 
 	currentDir := localDir
 
+	// Times of the next file or directory, and of the directories
+	// being received, applied once their contents are written
+	var times *scpTimes
+	var dirTimes []*scpTimes
+
 	for {
 		buffer, n, err := s.readMessage(reader)
 		if err == io.EOF {
@@ -365,7 +542,12 @@ func (s *scpSession) getDir(localDir string) error {
 
 		msgType := string(buffer[0])
 
-		if msgType == msgStartDir {
+		if msgType == msgTime {
+			times, err = parseTimes(buffer[1 : n-1])
+			if err != nil {
+				return err
+			}
+		} else if msgType == msgStartDir {
 			msg = string(buffer[1 : n-1])
 			fields = strings.Split(msg, " ")
 
@@ -377,6 +559,9 @@ func (s *scpSession) getDir(localDir string) error {
 			if err != nil {
 				return err
 			}
+
+			dirTimes = append(dirTimes, times)
+			times = nil
 		} else if msgType == msgCopyFile {
 			msg = string(buffer[1 : n-1])
 			fields = strings.Split(msg, " ")
@@ -389,31 +574,27 @@ func (s *scpSession) getDir(localDir string) error {
 			if err != nil {
 				return err
 			}
+
+			err = times.apply(newFile)
+			if err != nil {
+				return err
+			}
+
+			times = nil
 		} else if msgType == msgEndDir {
 			s.myClient.logger.Infow("E message", "olddir", currentDir, "newdir", path.Dir(currentDir))
-			currentDir = path.Dir(currentDir)
-		}
-	}
-}
 
-// waitTimeout waits for the waitgroup for the specified max timeout.
-// Returns true if waiting timed out.
-func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
-	c := make(chan struct{})
+			if len(dirTimes) > 0 {
+				err := dirTimes[len(dirTimes)-1].apply(currentDir)
+				if err != nil {
+					return err
+				}
 
-	// Wait for all wait groups are closed
-	// and then, close channel
-	go func() {
-		defer close(c)
-		wg.Wait()
-	}()
+				dirTimes = dirTimes[:len(dirTimes)-1]
+			}
 
-	// Select either channel closed or timeout
-	select {
-	case <-c:
-		return false // completed normally
-	case <-time.After(timeout):
-		return true // timed out
+			currentDir = path.Dir(currentDir)
+		}
 	}
 }
 
@@ -433,29 +614,49 @@ func (s *scpSession) execSCPSession(kind int, dest string, fn func() error) erro
 		return fmt.Errorf("scp type unknown. Only file or dir is supported")
 	}
 
+	if s.preserveTimes {
+		opt = "-p" + opt[1:]
+	}
+
 	defer s.session.Close()
 
-	// Create group to wait 2 routines: start cmd & transfer
-	wg := sync.WaitGroup{}
-	wg.Add(2)
+	// The path is quoted for the shell of the remote user
+	cmd := "scp " + opt + " " + shellQuotePath(dest)
 
-	// Create a channel for 2 errors:
-	// - Start cmd scp
-	// - Exec handler scp command
-	errCh := make(chan error, 2)
+	// Execute scp as another user
+	become := s.myClient.become
+	if become != nil {
+		var err error
 
-	// Start command
-	go func() {
-		defer wg.Done()
+		cmd, err = become.command(cmd, false)
+		if err != nil {
+			return err
+		}
+	}
 
-		cmd := "scp " + opt + " " + dest
+	err := s.session.Start(cmd)
+	if err != nil {
+		return err
+	}
 
-		err := s.session.Start(cmd)
+	if become != nil {
+		s.out, s.err, err = become.escalate(s.ctx, s.in, s.out, s.err)
 		if err != nil {
-			errCh <- err
-			return
+			return err
 		}
-	}()
+	}
+
+	// Errors are reported by the protocol: stderr is drained until
+	// the session is closed so that it does not fill the window of
+	// the channel or block the privilege escalation
+	go io.Copy(ioutil.Discard, s.err)
+
+	// Create group to wait the transfer routine
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+
+	// Create a channel for the error of the scp handler
+	errCh := make(chan error, 1)
 
 	// Exec scp handler command
 	go func() {
@@ -469,20 +670,31 @@ func (s *scpSession) execSCPSession(kind int, dest string, fn func() error) erro
 		}
 	}()
 
-	// Wait for timeout or all wait groupsare done
-	if waitTimeout(&wg, s.timeout) {
-		return fmt.Errorf("timeout when upload files")
-	}
+	done := make(chan error, 1)
 
-	close(errCh)
+	go func() {
+		wg.Wait()
+		close(errCh)
 
-	for err := range errCh {
-		if err != nil {
-			return err
+		for err := range errCh {
+			if err != nil {
+				done <- err
+				return
+			}
 		}
-	}
 
-	return s.session.Wait()
+		done <- s.session.Wait()
+	}()
+
+	// Wait for the end of the transfer or the context: the session is
+	// closed to unblock the routines
+	select {
+	case err := <-done:
+		return err
+	case <-s.ctx.Done():
+		abortSession(s.session, done)
+		return context.Cause(s.ctx)
+	}
 }
 
 func (s *scpSession) readReply() error {
@@ -554,77 +766,142 @@ func (s *scpSession) readMessage(reader *bufio.Reader) ([]byte, int, error) {
 }
 
 func (s *scpSession) readFileData(reader *bufio.Reader, file string, mode os.FileMode, length int) error {
-	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, mode)
+	f, err := os.OpenFile(file, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, mode)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
-	cpt := 0
+	err = s.readData(reader, f, int64(length))
+	if err != nil {
+		return err
+	}
 
-	_, err = s.in.Write([]byte{msgOK})
+	return f.Sync()
+}
+
+// readData acknowledges the header of a file, then copies its length
+// bytes of data to w and reads the status ending them
+func (s *scpSession) readData(reader *bufio.Reader, w io.Writer, length int64) error {
+	_, err := s.in.Write([]byte{msgOK})
 	if err != nil {
 		return err
 	}
 
-	//fmt.Println("length", length)
-	buf := make([]byte, bufferSizeDataFile)
+	_, err = io.CopyN(w, reader, length)
+	if err != nil {
+		return fmt.Errorf("error while reading data file: err=%s", err)
+	}
+
+	status, err := reader.ReadByte()
+	if err != nil {
+		return fmt.Errorf("error while reading data file: err=%s", err)
+	}
 
-	for {
-		reachEnd := false
-
-		n, _ := reader.Read(buf)
-
-		//s.myClient.logger.Debugw("Data file read", "buf", string(buf[:n]), "len", n)
-
-		nbRead := n
-
-		cpt = cpt + n
-		if cpt >= length {
-			reachEnd = true
-
-			s.myClient.logger.Debugw("End data file (before last byte check)", "buf", string(buf[:nbRead]), "nbRead", nbRead, "cpt", cpt)
-
-			// For some unknown reasons, when we have buffer's size greater
-			// than the data length, in some cases, the byte msgOK '\x00'
-			// is not tramsitted in the same message data, but in the next one:
-			// protocol message. We need to be sure that, in this case, we dont
-			// remove the last byte which is '\n' instead of '\x00'.
-			// For ex:
-			// length 6
-			// raw data "test1\n", 6
-			// ##########################################
-			// raw data length 6, nbRead 5
-			// n 15
-			// buffer "\x00C0644 6 test2\n"
-
-			// In the case where '\x00' is transmitted in the same data message, for example:
-			// INFO:  C message                                           fields=["0644" "1679" "id_rsa"] file="/tmp/remote/data/id_rsa"
-			// DEBUG: End data file                                       buf="XSzUgjr0T63gy5YtHDUrf43bMCKTAvLi05yxwu6VV\nP2WdpQKBgQCOuv5dNIk2XF/RWTQnxYqVAOhMQ6gRgbp8aHEZfnfUmBrhRyZ+kWP0\nxs8+67AmUOMazYmxwygBac7w64m212aDKm0hAO7micqAuKEkFjfph9D6ajYWfQOX\nkH4zgj76wYBOjiQfYtXhouUjsZtpN3Ipz6fLTOeA8NMur+FPg7pzGQ==\n-----END RSA PRIVATE KEY-----\n" nbRead=259 cpt=1680
-			// We have the cpt is greater than length of 1 which is '\x00' transmitted. Only in this case, we remove the last byte. Indeed, for linux binary, \x00 can be a byte of binary.
-			if cpt == length+1 && buf[n-1] == msgOK {
-				nbRead = nbRead - 1
-			}
+	if status != msgOK {
+		msg, _ := reader.ReadString('\n')
+		return fmt.Errorf("%s", msg)
+	}
 
-			s.myClient.logger.Debugw("End data file", "buf", string(buf[:nbRead]), "nbRead", nbRead, "cpt", cpt)
-		}
+	return nil
+}
+
+//////// INTERNAL FUNCTIONS //////////
+
+// sizedReader reads the size first bytes of r, failing if r ends
+// before, so that the data sent matches the announced length
+type sizedReader struct {
+	r      io.Reader
+	remain int64
+}
+
+func (s *sizedReader) Read(p []byte) (int, error) {
+	if s.remain <= 0 {
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > s.remain {
+		p = p[:s.remain]
+	}
+
+	n, err := s.r.Read(p)
+	s.remain -= int64(n)
+
+	if err == io.EOF && s.remain > 0 {
+		err = io.ErrUnexpectedEOF
+	}
 
-		nbWrite, err := f.Write(buf[:nbRead])
+	return n, err
+}
+
+// scpTimes are the times of a file given by a T message
+type scpTimes struct {
+	modTime    time.Time
+	accessTime time.Time
+}
+
+// parseFileHeader parses the content of a C message:
+// <mode> <size> <name>
+func parseFileHeader(msg []byte) (*SCPFileInfo, error) {
+	fields := strings.SplitN(string(msg), " ", 3)
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("invalid file message: %q", msg)
+	}
+
+	mode, err := strconv.ParseUint(fields[0], 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid file mode: %q", fields[0])
+	}
+
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || size < 0 {
+		return nil, fmt.Errorf("invalid file size: %q", fields[1])
+	}
+
+	info := &SCPFileInfo{
+		Name: fields[2],
+		Mode: os.FileMode(mode) & os.ModePerm,
+		Size: size,
+	}
+
+	return info, nil
+}
+
+// parseTimes parses the content of a T message:
+// <mtime> <mtime usec> <atime> <atime usec>
+func parseTimes(msg []byte) (*scpTimes, error) {
+	fields := strings.Fields(string(msg))
+	if len(fields) != 4 {
+		return nil, fmt.Errorf("invalid times message: %q", msg)
+	}
+
+	values := make([]int64, 4)
+
+	for i, field := range fields {
+		value, err := strconv.ParseInt(field, 10, 64)
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("invalid times message: %q", msg)
 		}
 
-		if nbWrite != nbRead {
-			return fmt.Errorf("bytes (%d) written to the file is not the same as bytes read (%d)", nbWrite, nbRead)
-		}
+		values[i] = value
+	}
 
-		if reachEnd {
-			return f.Sync()
-		}
+	t := &scpTimes{
+		modTime:    time.Unix(values[0], values[1]*1000),
+		accessTime: time.Unix(values[2], values[3]*1000),
 	}
+
+	return t, nil
 }
 
-//////// INTERNAL FUNCTIONS //////////
+// apply sets the times of the local file, if any
+func (t *scpTimes) apply(file string) error {
+	if t == nil {
+		return nil
+	}
+
+	return os.Chtimes(file, t.accessTime, t.modTime)
+}
 
 func createLocalDir(dir string, mode os.FileMode) error {
 	// Check whether dir exists.
@@ -0,0 +1,584 @@
+package gossh
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// Transfer is the protocol used by the SCP methods to transfer files
+type Transfer int
+
+const (
+	// TransferSCP runs the scp command of the remote machine
+	TransferSCP Transfer = iota
+	// TransferSFTP uses the sftp subsystem, available even when the
+	// scp command is not installed
+	TransferSFTP
+	// TransferAuto uses scp if the remote machine has it, sftp
+	// otherwise. scp is always used with a privilege escalation.
+	TransferAuto
+)
+
+type sftpSession struct {
+	client *sftp.Client
+
+	// Keep the times of the transferred files
+	preserveTimes bool
+}
+
+// Stat returns the information of the remote file. Symbolic links
+// are followed.
+func (c *Client) Stat(remotePath string) (os.FileInfo, error) {
+	return c.StatContext(context.Background(), remotePath)
+}
+
+// StatContext is Stat aborting the operation
+// when ctx is done
+func (c *Client) StatContext(ctx context.Context, remotePath string) (os.FileInfo, error) {
+	var info os.FileInfo
+
+	err := c.sftp(ctx, func(s *sftpSession) error {
+		var err error
+
+		info, err = s.client.Stat(remotePath)
+
+		return err
+	})
+
+	return info, err
+}
+
+// ReadDir returns the information of the files in the remote
+// directory
+func (c *Client) ReadDir(remoteDir string) ([]os.FileInfo, error) {
+	return c.ReadDirContext(context.Background(), remoteDir)
+}
+
+// ReadDirContext is ReadDir aborting the operation
+// when ctx is done
+func (c *Client) ReadDirContext(ctx context.Context, remoteDir string) ([]os.FileInfo, error) {
+	var infos []os.FileInfo
+
+	err := c.sftp(ctx, func(s *sftpSession) error {
+		var err error
+
+		infos, err = s.client.ReadDir(remoteDir)
+
+		return err
+	})
+
+	return infos, err
+}
+
+// Remove removes the remote file or empty directory
+func (c *Client) Remove(remotePath string) error {
+	return c.RemoveContext(context.Background(), remotePath)
+}
+
+// RemoveContext is Remove aborting the operation
+// when ctx is done
+func (c *Client) RemoveContext(ctx context.Context, remotePath string) error {
+	return c.sftp(ctx, func(s *sftpSession) error {
+		return s.client.Remove(remotePath)
+	})
+}
+
+// Rename renames the remote file or directory
+func (c *Client) Rename(oldPath, newPath string) error {
+	return c.RenameContext(context.Background(), oldPath, newPath)
+}
+
+// RenameContext is Rename aborting the operation
+// when ctx is done
+func (c *Client) RenameContext(ctx context.Context, oldPath, newPath string) error {
+	return c.sftp(ctx, func(s *sftpSession) error {
+		return s.client.Rename(oldPath, newPath)
+	})
+}
+
+// Mkdir creates the remote directory with the given mode. Its parent
+// must exist.
+func (c *Client) Mkdir(remoteDir string, mode os.FileMode) error {
+	return c.MkdirContext(context.Background(), remoteDir, mode)
+}
+
+// MkdirContext is Mkdir aborting the operation
+// when ctx is done
+func (c *Client) MkdirContext(ctx context.Context, remoteDir string, mode os.FileMode) error {
+	return c.sftp(ctx, func(s *sftpSession) error {
+		err := s.client.Mkdir(remoteDir)
+		if err != nil {
+			return err
+		}
+
+		return s.client.Chmod(remoteDir, mode)
+	})
+}
+
+// Chmod changes the mode of the remote file
+func (c *Client) Chmod(remotePath string, mode os.FileMode) error {
+	return c.ChmodContext(context.Background(), remotePath, mode)
+}
+
+// ChmodContext is Chmod aborting the operation
+// when ctx is done
+func (c *Client) ChmodContext(ctx context.Context, remotePath string, mode os.FileMode) error {
+	return c.sftp(ctx, func(s *sftpSession) error {
+		return s.client.Chmod(remotePath, mode)
+	})
+}
+
+// Symlink creates the remote symbolic link newPath pointing to
+// oldPath
+func (c *Client) Symlink(oldPath, newPath string) error {
+	return c.SymlinkContext(context.Background(), oldPath, newPath)
+}
+
+// SymlinkContext is Symlink aborting the operation
+// when ctx is done
+func (c *Client) SymlinkContext(ctx context.Context, oldPath, newPath string) error {
+	return c.sftp(ctx, func(s *sftpSession) error {
+		return s.client.Symlink(oldPath, newPath)
+	})
+}
+
+// SFTP runs fn with a client of the sftp subsystem. The methods above
+// open a new session for each operation: fn makes a batch of them in
+// a single one, closed once it returns.
+func (c *Client) SFTP(fn func(client *sftp.Client) error) error {
+	return c.SFTPContext(context.Background(), fn)
+}
+
+// SFTPContext is SFTP aborting the operations when ctx is done: the
+// session is closed, failing the pending operations of fn
+func (c *Client) SFTPContext(ctx context.Context, fn func(client *sftp.Client) error) error {
+	return c.sftp(ctx, func(s *sftpSession) error {
+		return fn(s.client)
+	})
+}
+
+// SendBytes writes the content to the remote file as
+// scpSession.SendBytes
+func (s *sftpSession) SendBytes(content []byte, remoteFile, mode string) error {
+	if mode == "" {
+		mode = "0755"
+	}
+
+	perm, err := parseMode(mode)
+	if err != nil {
+		return err
+	}
+
+	return s.sendFile(perm, nil, remoteFile, bytes.NewReader(content))
+}
+
+// SendReader writes the content of r to the remote file as
+// scpSession.SendReader. The content is streamed: size may be
+// negative if unknown.
+func (s *sftpSession) SendReader(r io.Reader, size int64, remoteFile, mode string) error {
+	if mode == "" {
+		mode = "0755"
+	}
+
+	perm, err := parseMode(mode)
+	if err != nil {
+		return err
+	}
+
+	if size >= 0 {
+		r = &sizedReader{r: r, remain: size}
+	}
+
+	return s.sendFile(perm, nil, remoteFile, r)
+}
+
+// SendFile sends the local file to the remote machine as
+// scpSession.SendFile
+func (s *sftpSession) SendFile(localFile, remoteFile, mode string) error {
+	localFile = filepath.Clean(localFile)
+	remoteFile = path.Clean(remoteFile)
+
+	fileInfo, err := os.Stat(localFile)
+	if err != nil {
+		return fmt.Errorf("failed to stat local file: err=%s", err)
+	}
+
+	if fileInfo.IsDir() {
+		return fmt.Errorf("local file must a regular file, not a directory")
+	}
+
+	perm := fileInfo.Mode() & os.ModePerm
+
+	if mode != "" {
+		perm, err = parseMode(mode)
+		if err != nil {
+			return err
+		}
+	}
+
+	file, err := os.Open(localFile)
+	if err != nil {
+		return fmt.Errorf("failed to open local file: err=%s", err)
+	}
+	defer file.Close()
+
+	return s.sendFile(perm, fileInfo, remoteFile, file)
+}
+
+// SendDir sends recursively the local directory into the remote one
+// as scpSession.SendDir
+func (s *sftpSession) SendDir(localDir, remoteDir, mode string) error {
+	localDir = filepath.Clean(localDir)
+	remoteDir = path.Clean(remoteDir)
+
+	fileInfo, err := os.Stat(localDir)
+	if err != nil {
+		return fmt.Errorf("failed to stat local directory: err=%s", err)
+	}
+
+	perm := fileInfo.Mode() & os.ModePerm
+
+	if mode != "" {
+		perm, err = parseMode(mode)
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.sendDir(localDir, path.Join(remoteDir, filepath.Base(localDir)), fileInfo, perm)
+}
+
+// GetFile gets the remote file as scpSession.GetFile: into the local
+// directory if it exists, with the name of the remote file
+func (s *sftpSession) GetFile(remoteFile, localFile string) error {
+	localFile = filepath.Clean(localFile)
+	remoteFile = path.Clean(remoteFile)
+
+	fileInfo, err := os.Stat(localFile)
+	if os.IsNotExist(err) {
+		err = os.MkdirAll(filepath.Dir(localFile), 0755)
+		if err != nil {
+			return err
+		}
+	} else if err == nil && fileInfo.IsDir() {
+		localFile = filepath.Join(localFile, path.Base(remoteFile))
+	}
+
+	return s.getFile(remoteFile, localFile)
+}
+
+// GetToWriter writes the content of the remote file to w as
+// scpSession.getToWriter
+func (s *sftpSession) GetToWriter(remoteFile string, w io.Writer) (*SCPFileInfo, error) {
+	file, err := s.client.Open(remoteFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("remote path %s is not a regular file", remoteFile)
+	}
+
+	_, err = file.WriteTo(w)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading remote file %s: err=%s", remoteFile, err)
+	}
+
+	scpInfo := &SCPFileInfo{
+		Name: info.Name(),
+		Mode: info.Mode() & os.ModePerm,
+		Size: info.Size(),
+	}
+
+	return scpInfo, nil
+}
+
+// GetDir gets recursively the remote directory into the local one
+// as scpSession.GetDir
+func (s *sftpSession) GetDir(remoteDir, localDir string) error {
+	localDir = filepath.Clean(localDir)
+	remoteDir = path.Clean(remoteDir)
+
+	return s.getDir(remoteDir, filepath.Join(localDir, path.Base(remoteDir)))
+}
+
+///////// INTERNAL FUNCTIONS ////////////////////////////
+
+// sftp opens a new session with the sftp subsystem and runs the given
+// operations in it
+func (c *Client) sftp(ctx context.Context, fn func(s *sftpSession) error) error {
+	if c.become != nil {
+		return fmt.Errorf("privilege escalation is not supported by sftp")
+	}
+
+	c.checkLogEnvVars()
+
+	ctx, cancel := c.context(ctx)
+	defer cancel()
+
+	session, err := c.newSession(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	done := make(chan error, 1)
+
+	go func() {
+		client, err := startSFTP(session)
+		if err != nil {
+			done <- err
+			return
+		}
+		defer client.Close()
+
+		done <- fn(&sftpSession{client: client})
+	}()
+
+	// Closing the session unblocks the pending operations
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		session.Close()
+		<-done
+
+		return context.Cause(ctx)
+	}
+}
+
+// startSFTP starts the sftp subsystem in the session and returns the
+// client using it
+func startSFTP(session *ssh.Session) (*sftp.Client, error) {
+	in, err := session.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := session.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	err = session.RequestSubsystem("sftp")
+	if err != nil {
+		return nil, fmt.Errorf("failed to start sftp subsystem: err=%s", err)
+	}
+
+	client, err := sftp.NewClientPipe(out, in)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize sftp: err=%s", err)
+	}
+
+	return client, nil
+}
+
+// sendFile writes the content to the remote file, into it if it is
+// a directory as scp does. The times of the local file info are kept
+// if they are preserved.
+func (s *sftpSession) sendFile(mode os.FileMode, info os.FileInfo, remoteFile string, content io.Reader) error {
+	if info, err := s.client.Stat(remoteFile); err == nil && info.IsDir() {
+		remoteFile = path.Join(remoteFile, path.Base(remoteFile))
+	}
+
+	file, err := s.client.OpenFile(remoteFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return fmt.Errorf("failed to create remote file %s: err=%s", remoteFile, err)
+	}
+
+	_, err = file.ReadFrom(content)
+	if err == nil {
+		err = file.Chmod(mode)
+	}
+
+	errClose := file.Close()
+
+	if err != nil {
+		return fmt.Errorf("error while writing content file: err=%s", err)
+	}
+
+	if errClose != nil {
+		return fmt.Errorf("error while closing remote file %s: err=%s", remoteFile, errClose)
+	}
+
+	// The times are set once the file is closed, its last writes
+	// being done
+	return s.sendTimes(info, remoteFile)
+}
+
+// sendTimes sets the times of the remote file to those of the local
+// file info, if they are preserved
+func (s *sftpSession) sendTimes(info os.FileInfo, remoteFile string) error {
+	if !s.preserveTimes || info == nil {
+		return nil
+	}
+
+	return s.client.Chtimes(remoteFile, fileAccessTime(info), info.ModTime())
+}
+
+// sendDir creates the remote directory and sends the contents of
+// the local one into it. Files and subdirectories keep their local
+// mode.
+func (s *sftpSession) sendDir(localDir, remoteDir string, info os.FileInfo, mode os.FileMode) error {
+	files, err := ioutil.ReadDir(localDir)
+	if err != nil {
+		return err
+	}
+
+	err = s.client.Mkdir(remoteDir)
+	if err != nil {
+		if info, errStat := s.client.Stat(remoteDir); errStat != nil || !info.IsDir() {
+			return fmt.Errorf("failed to create remote directory %s: err=%s", remoteDir, err)
+		}
+	}
+
+	err = s.client.Chmod(remoteDir, mode)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		localFile := filepath.Join(localDir, file.Name())
+		remoteFile := path.Join(remoteDir, file.Name())
+		perm := file.Mode() & os.ModePerm
+
+		if file.IsDir() {
+			err = s.sendDir(localFile, remoteFile, file, perm)
+		} else if file.Mode().IsRegular() {
+			err = s.sendLocalFile(localFile, remoteFile, file)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	// The times of the directory are set once its contents are written
+	return s.sendTimes(info, remoteDir)
+}
+
+// sendLocalFile sends the content of the local file with its mode
+func (s *sftpSession) sendLocalFile(localFile, remoteFile string, info os.FileInfo) error {
+	file, err := os.Open(localFile)
+	if err != nil {
+		return fmt.Errorf("failed to open local file: err=%s", err)
+	}
+	defer file.Close()
+
+	return s.sendFile(info.Mode()&os.ModePerm, info, remoteFile, file)
+}
+
+// getFile writes the content of the remote file to the local one
+// with the remote mode
+func (s *sftpSession) getFile(remoteFile, localFile string) error {
+	file, err := s.client.Open(remoteFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(localFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode()&os.ModePerm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = file.WriteTo(f)
+	if err != nil {
+		return fmt.Errorf("error while writing local file %s: err=%s", localFile, err)
+	}
+
+	err = os.Chmod(localFile, info.Mode()&os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	return s.getTimes(info, localFile)
+}
+
+// getTimes sets the times of the local file to those of the remote
+// file info, if they are preserved
+func (s *sftpSession) getTimes(info os.FileInfo, localFile string) error {
+	if !s.preserveTimes {
+		return nil
+	}
+
+	accessTime := info.ModTime()
+	if stat, ok := info.Sys().(*sftp.FileStat); ok {
+		accessTime = time.Unix(int64(stat.Atime), 0)
+	}
+
+	return os.Chtimes(localFile, accessTime, info.ModTime())
+}
+
+// getDir creates the local directory and gets the contents of the
+// remote one into it
+func (s *sftpSession) getDir(remoteDir, localDir string) error {
+	info, err := s.client.Stat(remoteDir)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		return fmt.Errorf("remote path %s is not a directory", remoteDir)
+	}
+
+	err = os.MkdirAll(localDir, info.Mode()&os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	files, err := s.client.ReadDir(remoteDir)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		remoteFile := path.Join(remoteDir, file.Name())
+		localFile := filepath.Join(localDir, file.Name())
+
+		if file.IsDir() {
+			err = s.getDir(remoteFile, localFile)
+		} else if file.Mode().IsRegular() {
+			err = s.getFile(remoteFile, localFile)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.getTimes(info, localDir)
+}
+
+// parseMode parses the octal mode of the transfers, as 0644
+func parseMode(mode string) (os.FileMode, error) {
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid mode %q: err=%s", mode, err)
+	}
+
+	return os.FileMode(perm) & os.ModePerm, nil
+}
@@ -0,0 +1,234 @@
+package gossh
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/sftp"
+
+	"github.com/stretchr/testify/require"
+)
+
+func sftpHandler(s ssh.Session) {
+	server, err := sftp.NewServer(s)
+	if err != nil {
+		return
+	}
+
+	server.Serve()
+	server.Close()
+}
+
+func TestSFTP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gossh")
+	require.Nil(t, err)
+
+	defer os.RemoveAll(dir)
+
+	// Remote machine without scp
+	s := &ssh.Server{
+		Addr: ":2222",
+		Handler: func(s ssh.Session) {
+			s.Exit(127)
+		},
+		SubsystemHandlers: map[string]ssh.SubsystemHandler{
+			"sftp": sftpHandler,
+		},
+		PasswordHandler: func(ctx ssh.Context, password string) bool {
+			return ctx.User() == "user" && password == "pass"
+		},
+	}
+	go s.ListenAndServe()
+
+	defer s.Close()
+
+	time.Sleep(3 * time.Second)
+
+	config, err := NewClientConfigWithUserPass("user", "pass", "localhost", 2222, false)
+	require.Nil(t, err)
+
+	client, err := NewClient(config)
+	require.Nil(t, err)
+
+	defer client.Close()
+
+	client.SetTransfer(TransferAuto)
+
+	// Transfers
+	err = client.SCPSendBytes([]byte("HelloWorld"), dir+"/bytes", "0600")
+	require.Nil(t, err)
+
+	content, err := ioutil.ReadFile(dir + "/bytes")
+	require.Nil(t, err)
+	require.Equal(t, "HelloWorld", string(content))
+
+	local := filepath.Join(dir, "local")
+
+	err = os.MkdirAll(local+"/sub", 0755)
+	require.Nil(t, err)
+
+	err = ioutil.WriteFile(local+"/sub/file", []byte("HelloSub"), 0640)
+	require.Nil(t, err)
+
+	err = client.SCPSendFile(local+"/sub/file", dir+"/file", "")
+	require.Nil(t, err)
+
+	info, err := client.Stat(dir + "/file")
+	require.Nil(t, err)
+	require.Equal(t, int64(8), info.Size())
+	require.Equal(t, os.FileMode(0640), info.Mode().Perm())
+
+	err = client.Mkdir(dir+"/remote", 0700)
+	require.Nil(t, err)
+
+	err = client.SCPSendDir(local, dir+"/remote", "0750")
+	require.Nil(t, err)
+
+	content, err = ioutil.ReadFile(dir + "/remote/local/sub/file")
+	require.Nil(t, err)
+	require.Equal(t, "HelloSub", string(content))
+
+	err = client.SCPGetFile(dir+"/bytes", dir+"/got/bytes")
+	require.Nil(t, err)
+
+	content, err = ioutil.ReadFile(dir + "/got/bytes")
+	require.Nil(t, err)
+	require.Equal(t, "HelloWorld", string(content))
+
+	err = client.SCPGetDir(dir+"/remote/local", dir+"/got")
+	require.Nil(t, err)
+
+	content, err = ioutil.ReadFile(dir + "/got/local/sub/file")
+	require.Nil(t, err)
+	require.Equal(t, "HelloSub", string(content))
+
+	// File operations
+	infos, err := client.ReadDir(dir + "/remote/local")
+	require.Nil(t, err)
+	require.Len(t, infos, 1)
+	require.Equal(t, "sub", infos[0].Name())
+	require.True(t, infos[0].IsDir())
+
+	err = client.Chmod(dir+"/bytes", 0644)
+	require.Nil(t, err)
+
+	err = client.Rename(dir+"/bytes", dir+"/renamed")
+	require.Nil(t, err)
+
+	err = client.Symlink(dir+"/renamed", dir+"/link")
+	require.Nil(t, err)
+
+	info, err = client.Stat(dir + "/link")
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0644), info.Mode().Perm())
+
+	err = client.Remove(dir + "/link")
+	require.Nil(t, err)
+
+	_, err = client.Stat(dir + "/link")
+	require.True(t, os.IsNotExist(err))
+
+	// Operations in a single session
+	err = client.SFTP(func(s *sftp.Client) error {
+		err := s.MkdirAll(dir + "/batch/sub")
+		if err != nil {
+			return err
+		}
+
+		return s.Rename(dir+"/renamed", dir+"/batch/sub/renamed")
+	})
+	require.Nil(t, err)
+
+	content, err = ioutil.ReadFile(dir + "/batch/sub/renamed")
+	require.Nil(t, err)
+	require.Equal(t, "HelloWorld", string(content))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = client.StatContext(ctx, dir+"/batch")
+	require.Equal(t, context.Canceled, err)
+
+	// No privilege escalation with sftp
+	client.SetTransfer(TransferSFTP)
+	client.SetBecome(&Become{})
+
+	err = client.SCPSendBytes([]byte("HelloWorld"), dir+"/bytes", "0600")
+	require.Equal(t, "privilege escalation is not supported by sftp", err.Error())
+}
+
+func TestGetFileIntoDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gossh")
+	require.Nil(t, err)
+
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(dir+"/remote.txt", []byte("HelloWorld"), 0644)
+	require.Nil(t, err)
+
+	// Remote machine with scp and sftp
+	s := &ssh.Server{
+		Addr:    ":2222",
+		Handler: sessionHandler,
+		SubsystemHandlers: map[string]ssh.SubsystemHandler{
+			"sftp": sftpHandler,
+		},
+		PasswordHandler: func(ctx ssh.Context, password string) bool {
+			return ctx.User() == "user" && password == "pass"
+		},
+	}
+	go s.ListenAndServe()
+
+	defer s.Close()
+
+	time.Sleep(3 * time.Second)
+
+	config, err := NewClientConfigWithUserPass("user", "pass", "localhost", 2222, false)
+	require.Nil(t, err)
+
+	client, err := NewClient(config)
+	require.Nil(t, err)
+
+	defer client.Close()
+
+	testCases := []struct {
+		name     string
+		transfer Transfer
+	}{
+		{
+			"OKSCP",
+			TransferSCP,
+		},
+		{
+			"OKSFTP",
+			TransferSFTP,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			local := filepath.Join(dir, tc.name, "local")
+
+			err := os.MkdirAll(local, 0755)
+			require.Nil(t, err)
+
+			client.SetTransfer(tc.transfer)
+
+			// The file is written into the directory itself
+			err = client.SCPGetFile(dir+"/remote.txt", local)
+			require.Nil(t, err)
+
+			content, err := ioutil.ReadFile(filepath.Join(local, "remote.txt"))
+			require.Nil(t, err)
+			require.Equal(t, "HelloWorld", string(content))
+
+			_, err = os.Stat(filepath.Join(dir, tc.name, "remote.txt"))
+			require.True(t, os.IsNotExist(err))
+		})
+	}
+}
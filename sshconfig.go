@@ -0,0 +1,408 @@
+package gossh
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	sshconfig "github.com/kevinburke/ssh_config"
+)
+
+// Default private keys loaded by OpenSSH when no IdentityFile is given
+var defaultIdentityFiles = []string{
+	"~/.ssh/id_rsa",
+	"~/.ssh/id_ecdsa",
+	"~/.ssh/id_ed25519",
+}
+
+// System configuration file used after the user's one
+var systemSSHConfigFile = "/etc/ssh/ssh_config"
+
+// Maximum number of jump hosts followed through ProxyJump, to avoid
+// loops
+const maxProxyJumpDepth = 8
+
+// sshConfig looks up the settings of a host alias in the user's
+// configuration file first, then in the system one
+type sshConfig struct {
+	alias string
+	files []*sshconfig.Config
+	depth int
+
+	// Whether the ProxyJump of the alias is followed
+	proxyJump bool
+}
+
+// NewConfigFromSSHConfig returns the configuration of the given host
+// alias as defined in $HOME/.ssh/config and /etc/ssh/ssh_config,
+// following the Host patterns and the Include directives.
+//
+// The following settings are used: HostName, Port, User,
+// IdentityFile, CertificateFile, ProxyJump, UserKnownHostsFile,
+// GlobalKnownHostsFile, StrictHostKeyChecking, HashKnownHosts and
+// ConnectTimeout. The given options are applied after them and may
+// override them.
+func NewConfigFromSSHConfig(alias string, opts ...Option) (*Config, error) {
+	return newConfigFromSSHConfig(alias, 0, true, opts...)
+}
+
+/////////// PRIVATE FUNCTIONS ////////////////////////////
+
+// newConfigFromSSHConfig returns the configuration of the alias.
+// depth is the number of jump hosts already followed to reach it.
+// Its own ProxyJump is ignored if proxyJump is false.
+func newConfigFromSSHConfig(alias string, depth int, proxyJump bool, opts ...Option) (*Config, error) {
+	if depth > maxProxyJumpDepth {
+		return nil, fmt.Errorf("too many ProxyJump hops to reach %s", alias)
+	}
+
+	cfg, err := loadSSHConfig(alias, filepath.Join(os.Getenv("HOME"), ".ssh", "config"), systemSSHConfigFile)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.depth = depth
+	cfg.proxyJump = proxyJump
+
+	sshOpts, err := cfg.options()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewConfig(cfg.hostname(), append(sshOpts, opts...)...)
+}
+
+// loadSSHConfig parses the given configuration files for the alias.
+// Files which do not exist are ignored.
+func loadSSHConfig(alias string, files ...string) (*sshConfig, error) {
+	cfg := &sshConfig{alias: alias}
+
+	for _, file := range files {
+		f, err := os.Open(file)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		decoded, err := sshconfig.Decode(f)
+
+		f.Close()
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse ssh config %s: err=%s", file, err)
+		}
+
+		cfg.files = append(cfg.files, decoded)
+	}
+
+	return cfg, nil
+}
+
+// get returns the first value of the key for the alias or its
+// default value
+func (s *sshConfig) get(key string) (string, error) {
+	for _, file := range s.files {
+		value, err := file.Get(s.alias, key)
+		if err != nil {
+			return "", err
+		}
+
+		if value != "" {
+			return value, nil
+		}
+	}
+
+	return sshconfig.Default(key), nil
+}
+
+// getAll returns all the values of the key for the alias
+func (s *sshConfig) getAll(key string) ([]string, error) {
+	values := []string{}
+
+	for _, file := range s.files {
+		all, err := file.GetAll(s.alias, key)
+		if err != nil {
+			return nil, err
+		}
+
+		values = append(values, all...)
+	}
+
+	return values, nil
+}
+
+// hostname returns the real hostname of the alias
+func (s *sshConfig) hostname() string {
+	hostname, err := s.get("HostName")
+	if err != nil || hostname == "" {
+		return s.alias
+	}
+
+	return strings.ReplaceAll(hostname, "%h", s.alias)
+}
+
+// options returns the options corresponding to the settings of
+// the alias
+func (s *sshConfig) options() ([]Option, error) {
+	opts := []Option{}
+
+	port, err := s.get("Port")
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q for %s", port, s.alias)
+	}
+
+	opts = append(opts, WithPort(p))
+
+	username, err := s.get("User")
+	if err != nil {
+		return nil, err
+	}
+
+	if username != "" {
+		opts = append(opts, WithUser(username))
+	}
+
+	timeout, err := s.get("ConnectTimeout")
+	if err != nil {
+		return nil, err
+	}
+
+	if timeout != "" {
+		seconds, err := strconv.Atoi(timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid connect timeout %q for %s", timeout, s.alias)
+		}
+
+		opts = append(opts, WithTimeout(time.Duration(seconds)*time.Second))
+	}
+
+	proxyJump := ""
+
+	if s.proxyJump {
+		proxyJump, err = s.get("ProxyJump")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if proxyJump != "" && proxyJump != "none" {
+		// As with OpenSSH, only the first jump host is reached with
+		// its own ProxyJump: the next ones are reached through the
+		// previous jump hosts of the list.
+		for i, jump := range strings.Split(proxyJump, ",") {
+			jumpConfig, err := s.jumpConfig(jump, i == 0)
+			if err != nil {
+				return nil, err
+			}
+
+			opts = append(opts, WithJumpHost(jumpConfig))
+		}
+	}
+
+	identityOpts, err := s.identityOptions(username)
+	if err != nil {
+		return nil, err
+	}
+
+	opts = append(opts, identityOpts...)
+
+	policy, err := s.hostKeyPolicy()
+	if err != nil {
+		return nil, err
+	}
+
+	return append(opts, WithHostKeyPolicy(policy)), nil
+}
+
+// jumpConfig returns the configuration of a jump host given as
+// [user@]host[:port] by ProxyJump. The host is itself looked up in the
+// ssh config files, its own ProxyJump being followed if proxyJump is
+// true.
+func (s *sshConfig) jumpConfig(jump string, proxyJump bool) (*Config, error) {
+	opts := []Option{}
+
+	if i := strings.LastIndex(jump, "@"); i >= 0 {
+		opts = append(opts, WithUser(jump[:i]))
+		jump = jump[i+1:]
+	}
+
+	host := jump
+
+	if h, port, err := net.SplitHostPort(jump); err == nil {
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q for jump host %s", port, h)
+		}
+
+		host = h
+		opts = append(opts, WithPort(p))
+	}
+
+	return newConfigFromSSHConfig(host, s.depth+1, proxyJump, opts...)
+}
+
+// identityOptions returns the options adding the private keys given
+// by IdentityFile along with their certificates given by
+// CertificateFile or named as the key with the suffix -cert.pub.
+// Files which do not exist are ignored as with OpenSSH.
+func (s *sshConfig) identityOptions(username string) ([]Option, error) {
+	opts := []Option{}
+
+	identities, err := s.getAll("IdentityFile")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(identities) == 0 {
+		identities = defaultIdentityFiles
+	}
+
+	certificates, err := s.getAll("CertificateFile")
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range certificates {
+		certificates[i] = s.expand(certificates[i], username)
+	}
+
+	for _, identity := range identities {
+		keyFile := s.expand(identity, username)
+		if !fileExists(keyFile) {
+			continue
+		}
+
+		certFile := ""
+
+		for _, certificate := range certificates {
+			if certificate == keyFile+"-cert.pub" || (len(identities) == 1 && len(certificates) == 1) {
+				certFile = certificate
+			}
+		}
+
+		if certFile == "" && fileExists(keyFile+"-cert.pub") {
+			certFile = keyFile + "-cert.pub"
+		}
+
+		if certFile != "" && fileExists(certFile) {
+			opts = append(opts, WithCertificate(keyFile, certFile))
+		} else {
+			opts = append(opts, WithKeyFile(keyFile))
+		}
+	}
+
+	return opts, nil
+}
+
+// hostKeyPolicy returns the host key policy corresponding to
+// StrictHostKeyChecking with the known_hosts files of
+// UserKnownHostsFile and GlobalKnownHostsFile
+func (s *sshConfig) hostKeyPolicy() (HostKeyPolicy, error) {
+	strict, err := s.get("StrictHostKeyChecking")
+	if err != nil {
+		return nil, err
+	}
+
+	userFiles, err := s.knownHostsFiles("UserKnownHostsFile")
+	if err != nil {
+		return nil, err
+	}
+
+	globalFiles, err := s.knownHostsFiles("GlobalKnownHostsFile")
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(strict) {
+	case "no", "off":
+		return InsecureIgnoreHostKey(), nil
+	case "accept-new":
+		hashed, err := s.get("HashKnownHosts")
+		if err != nil {
+			return nil, err
+		}
+
+		file := ""
+		if len(userFiles) > 0 {
+			file = userFiles[0]
+		}
+
+		return TrustOnFirstUse(file, strings.ToLower(hashed) == "yes"), nil
+	case "yes", "ask", "":
+		// Unknown hosts cannot be asked: they are rejected
+		files := []string{}
+
+		for _, file := range append(userFiles, globalFiles...) {
+			if fileExists(file) {
+				files = append(files, file)
+			}
+		}
+
+		// Fails later, if the policy is not overridden, because
+		// the first file does not exist
+		if len(files) == 0 {
+			files = userFiles
+		}
+
+		return KnownHosts(files...), nil
+	default:
+		return nil, fmt.Errorf("invalid StrictHostKeyChecking %q for %s", strict, s.alias)
+	}
+}
+
+// knownHostsFiles returns the known_hosts files listed by the key
+func (s *sshConfig) knownHostsFiles(key string) ([]string, error) {
+	value, err := s.get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	files := strings.Fields(value)
+	for i := range files {
+		files[i] = s.expand(files[i], "")
+	}
+
+	return files, nil
+}
+
+// expand replaces the leading ~ and the tokens %d (local home
+// directory), %u (local user), %h (remote hostname), %r (remote user)
+// and %% of the given path
+func (s *sshConfig) expand(path, remoteUser string) string {
+	home := os.Getenv("HOME")
+
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		path = home + path[1:]
+	}
+
+	localUser := ""
+	if u, err := user.Current(); err == nil {
+		localUser = u.Username
+	}
+
+	replacer := strings.NewReplacer(
+		"%%", "%",
+		"%d", home,
+		"%u", localUser,
+		"%h", s.hostname(),
+		"%r", remoteUser,
+	)
+
+	return replacer.Replace(path)
+}
+
+func fileExists(file string) bool {
+	_, err := os.Stat(file)
+	return err == nil
+}
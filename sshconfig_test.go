@@ -0,0 +1,191 @@
+package gossh
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/gliderlabs/ssh"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewConfigFromSSHConfig(t *testing.T) {
+	home, err := ioutil.TempDir("", "gossh")
+	require.Nil(t, err)
+
+	defer os.RemoveAll(home)
+
+	oldHome := os.Getenv("HOME")
+	os.Setenv("HOME", home)
+
+	defer os.Setenv("HOME", oldHome)
+
+	oldSystemFile := systemSSHConfigFile
+	systemSSHConfigFile = filepath.Join(home, "ssh_config")
+
+	defer func() { systemSSHConfigFile = oldSystemFile }()
+
+	err = os.Mkdir(filepath.Join(home, ".ssh"), 0700)
+	require.Nil(t, err)
+
+	err = ioutil.WriteFile(filepath.Join(home, ".ssh", "known_hosts"), []byte{}, 0600)
+	require.Nil(t, err)
+
+	for _, file := range []string{"id_rsa", "id_rsa-cert.pub"} {
+		content, err := ioutil.ReadFile("./data/" + file)
+		require.Nil(t, err)
+
+		err = ioutil.WriteFile(filepath.Join(home, ".ssh", file), content, 0600)
+		require.Nil(t, err)
+	}
+
+	included := filepath.Join(home, "included.conf")
+
+	err = ioutil.WriteFile(included, []byte(`
+Host db
+  HostName db.example.com
+  Port 2200
+  StrictHostKeyChecking accept-new
+  UserKnownHostsFile ~/.ssh/db_known_hosts
+`), 0600)
+	require.Nil(t, err)
+
+	err = ioutil.WriteFile(filepath.Join(home, ".ssh", "config"), []byte(`
+Include `+included+`
+
+Host web* !web2
+  HostName localhost
+  Port 2222
+  User user
+  ConnectTimeout 5
+  StrictHostKeyChecking no
+
+Host jump
+  ProxyJump admin@bastion1:2022,bastion2
+
+Host bastion2
+  HostName 10.0.0.2
+  ProxyJump bastion3
+
+Host nested
+  ProxyJump bastion2
+
+Host loop
+  ProxyJump loop
+`), 0600)
+	require.Nil(t, err)
+
+	err = ioutil.WriteFile(systemSSHConfigFile, []byte(`
+Host *
+  User admin
+  IdentityFile ~/.ssh/id_rsa
+`), 0600)
+	require.Nil(t, err)
+
+	testCases := []struct {
+		name   string
+		alias  string
+		output interface{}
+	}{
+		{
+			"OKPattern",
+			"web1",
+			[]interface{}{"localhost", 2222, "user", 5 * time.Second, []identity{{filepath.Join(home, ".ssh", "id_rsa"), filepath.Join(home, ".ssh", "id_rsa-cert.pub")}}},
+		},
+		{
+			"OKNegatedPattern",
+			"web2",
+			[]interface{}{"web2", 22, "admin", time.Duration(0), []identity{{filepath.Join(home, ".ssh", "id_rsa"), filepath.Join(home, ".ssh", "id_rsa-cert.pub")}}},
+		},
+		{
+			"OKInclude",
+			"db",
+			[]interface{}{"db.example.com", 2200, "admin", time.Duration(0), []identity{{filepath.Join(home, ".ssh", "id_rsa"), filepath.Join(home, ".ssh", "id_rsa-cert.pub")}}},
+		},
+		{
+			"ErrProxyJumpLoop",
+			"loop",
+			"too many ProxyJump hops to reach loop",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config, err := NewConfigFromSSHConfig(tc.alias, WithHostKeyPolicy(InsecureIgnoreHostKey()))
+			if err != nil {
+				require.Equal(t, tc.output, err.Error())
+				return
+			}
+
+			require.Equal(t, tc.output, []interface{}{config.Host, config.Port, config.ClientConfig.User, config.ClientConfig.Timeout, config.identities})
+		})
+	}
+
+	// ProxyJump hosts are looked up in the config files. As with
+	// OpenSSH, the ProxyJump of the hosts following the first one of
+	// a list is ignored.
+	hopsTestCases := []struct {
+		alias  string
+		output []string
+	}{
+		{
+			"jump",
+			[]string{"admin@bastion1:2022", "admin@10.0.0.2:22", "admin@jump:22"},
+		},
+		{
+			"nested",
+			[]string{"admin@bastion3:22", "admin@10.0.0.2:22", "admin@nested:22"},
+		},
+	}
+
+	for _, tc := range hopsTestCases {
+		config, err := NewConfigFromSSHConfig(tc.alias, WithHostKeyPolicy(InsecureIgnoreHostKey()))
+		require.Nil(t, err)
+
+		hops := []string{}
+		for _, hop := range config.hops() {
+			hops = append(hops, hop.ClientConfig.User+"@"+hop.address())
+		}
+
+		require.Equal(t, tc.output, hops)
+	}
+
+	// accept-new creates the known_hosts file given by UserKnownHostsFile
+	_, err = NewConfigFromSSHConfig("db")
+	require.Nil(t, err)
+	require.FileExists(t, filepath.Join(home, ".ssh", "db_known_hosts"))
+
+	s := &ssh.Server{
+		Addr: ":2222",
+		Handler: func(s ssh.Session) {
+			fmt.Fprintf(s, "%s", strings.Join(s.Command(), " "))
+		},
+		PublicKeyHandler: func(ctx ssh.Context, key ssh.PublicKey) bool {
+			cert, ok := key.(*gossh.Certificate)
+			return ok && ctx.User() == "user" && cert.KeyId != ""
+		},
+	}
+	go s.ListenAndServe()
+
+	defer s.Close()
+
+	time.Sleep(3 * time.Second)
+
+	config, err := NewConfigFromSSHConfig("web1")
+	require.Nil(t, err)
+
+	client, err := NewClient(config)
+	require.Nil(t, err)
+
+	cmd := "echo HelloWorld"
+	res, err := client.ExecCommand(cmd)
+	require.Nil(t, err)
+	require.Equal(t, cmd, string(res))
+}